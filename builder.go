@@ -14,10 +14,13 @@ package main
 import (
 	"atlantis/builder/build"
 	"atlantis/builder/docker"
+	"atlantis/builder/git"
 	"atlantis/builder/layers"
+	"atlantis/common"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 )
 
 func main() {
@@ -28,15 +31,37 @@ func main() {
 	// App container builds.
 	var url = flag.String("url", "", "url of git repo")
 	var sha = flag.String("sha", "", "git sha to build")
+	var ref = flag.String("ref", "", "git branch, tag or short sha to build instead of sha")
 	var rel = flag.String("rel", "", "relative path in repository to build")
 	var manifestDir = flag.String("manifest-dir", "", "the directory to copy the manifest to")
+	var sparse = flag.Bool("sparse", false, "only check out the rel path and the manifest's source paths")
+	var shallow = flag.Bool("shallow", false, "only fetch the sha being built if the remote allows it")
+	var reproducible = flag.Bool("reproducible", false, "date the app's files to the commit and print a digest of them")
+	var output = flag.String("output", "", "save the app image to this path")
+	var outputFormat = flag.String("output-format", "docker", "save the app image as a docker save tarball (docker) or OCI image layout directory (oci)")
+	var noPush = flag.Bool("no-push", false, "don't push the app image to the registry")
 	flag.Parse()
 
 	registry := os.Getenv("REGISTRY")
-	if registry == "" {
+	if registry == "" && (*boot || !*noPush) {
 		panic("REGISTRY is not in the environment!")
 	}
-	client := docker.New(registry)
+	mirrors := []string{}
+	if env := os.Getenv("REGISTRY_MIRRORS"); env != "" {
+		mirrors = strings.Split(env, ",")
+	}
+	if dockerConfig := os.Getenv("REGISTRY_DOCKER_CONFIG"); dockerConfig != "" {
+		auths := []docker.RegistryAuth{}
+		for _, r := range append([]string{registry}, mirrors...) {
+			if r != "" {
+				auths = append(auths, docker.RegistryAuth{Registry: r, DockerConfig: dockerConfig})
+			}
+		}
+		if err := docker.SetRegistryAuths(auths); err != nil {
+			panic(err)
+		}
+	}
+	client := docker.New(registry, mirrors...)
 
 	if *boot {
 		fi, err := os.Stat(*path)
@@ -47,9 +72,25 @@ func main() {
 		}
 	} else {
 		docker.LogOutput = true
-		if *url == "" || *sha == "" || *rel == "" || *manifestDir == "" {
-			panic("provide url, sha, rel path, and manifest dir!")
+		if *url == "" || (*sha == "" && *ref == "") || *rel == "" || *manifestDir == "" {
+			panic("provide url, sha or ref, rel path, and manifest dir!")
+		}
+		// like the server, the image is named after the full sha, whatever the sha or ref given
+		given := *sha
+		if given == "" {
+			given = *ref
+		}
+		resolved, err := git.ResolveRef(*url, given)
+		if err != nil {
+			panic(err)
+		}
+		if resolved != given {
+			fmt.Printf("Resolved %s to %s\n", given, resolved)
 		}
-		build.App(client, *url, *sha, *rel, *manifestDir, layers.ReadLayerInfo(*path))
+		*sha = resolved
+		// builds run from the command line get an id of their own, like those the server runs
+		build.App(client, "cli-"+common.CreateRandomID(12), *url, *sha, *rel, *manifestDir, layers.ReadLayerInfo(*path),
+			build.Options{Sparse: *sparse, Shallow: *shallow, Reproducible: *reproducible,
+				Output: *output, OutputFormat: *outputFormat, NoPush: *noPush})
 	}
 }
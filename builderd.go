@@ -2,11 +2,15 @@ package main
 
 import (
 	"atlantis/builder/api"
+	"atlantis/builder/build"
 	"atlantis/builder/docker"
+	"atlantis/builder/git"
+	"atlantis/builder/manifest"
 	"flag"
 	"github.com/BurntSushi/toml"
 	"github.com/jigish/go-flags"
 	"log"
+	"time"
 )
 
 type ServerOpts struct {
@@ -15,7 +19,43 @@ type ServerOpts struct {
 }
 
 type BuilderConfig struct {
-	Registry string `toml:"registry_host"`
+	Registry      string                `toml:"registry_host"`
+	Mirrors       []string              `toml:"registry_mirrors"`
+	RegistryAuths []docker.RegistryAuth `toml:"registry_auth"`
+	RegistryRetry *docker.RetryPolicy   `toml:"registry_retry"`
+	LogForward    *manifest.LogForward  `toml:"log_forward"`
+	ProvenanceKey string                `toml:"provenance_key"`
+	MirrorDir     string                `toml:"git_mirror_dir"`
+	MirrorMaxAge  string                `toml:"git_mirror_max_age"`
+	ImageMaxAge   string                `toml:"image_max_age"`
+	Signatures    *git.SignaturePolicy  `toml:"commit_signatures"`
+	Credentials   []git.Credential      `toml:"git_credentials"`
+	URLPolicy     *api.URLPolicy        `toml:"url_policy"`
+	BuildLimits   *build.Limits         `toml:"build_limits"`
+}
+
+func pruneMirrors(maxAge time.Duration) {
+	for _ = range time.Tick(time.Hour) {
+		pruned, err := git.PruneMirrors(maxAge)
+		if err != nil {
+			log.Printf("Error pruning git mirrors: %v", err)
+		}
+		for _, url := range pruned {
+			log.Printf("Pruned git mirror of %s", url)
+		}
+	}
+}
+
+func pruneImages(builderAPI *api.BuilderAPI, maxAge time.Duration) {
+	for _ = range time.Tick(time.Hour) {
+		pruned, err := builderAPI.PruneImages(maxAge)
+		if err != nil {
+			log.Printf("Error pruning saved images: %v", err)
+		}
+		for _, id := range pruned {
+			log.Printf("Pruned saved image of build %s", id)
+		}
+	}
 }
 
 func main() {
@@ -34,6 +74,59 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if config.LogForward != nil {
+		if err := config.LogForward.Validate(); err != nil {
+			log.Fatalln(err)
+		}
+		build.DefaultLogForward = config.LogForward
+	}
+	if config.BuildLimits != nil {
+		if err := config.BuildLimits.Validate(); err != nil {
+			log.Fatalln(err)
+		}
+		build.BuildLimits = config.BuildLimits
+	}
+	if config.ProvenanceKey != "" {
+		if err := build.LoadProvenanceKey(config.ProvenanceKey); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if config.MirrorDir != "" {
+		git.MirrorDir = config.MirrorDir
+		maxAge := 7 * 24 * time.Hour
+		if config.MirrorMaxAge != "" {
+			if maxAge, err = time.ParseDuration(config.MirrorMaxAge); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		go pruneMirrors(maxAge)
+	}
+	git.Signatures = config.Signatures
+	git.Credentials = config.Credentials
 	docker.LogOutput = true
-	api.New(uint16(*port), config.Registry, *layerPath, *manifestDir).Run()
+	if err := docker.SetRegistryAuths(config.RegistryAuths); err != nil {
+		log.Fatalln(err)
+	}
+	if config.RegistryRetry != nil {
+		if err := config.RegistryRetry.Validate(); err != nil {
+			log.Fatalln(err)
+		}
+		docker.Retry = config.RegistryRetry
+	}
+	if config.URLPolicy != nil {
+		if err := config.URLPolicy.Compile(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	builderAPI := api.New(uint16(*port), config.Registry, config.Mirrors, *layerPath, *manifestDir)
+	builderAPI.URLPolicy = config.URLPolicy
+	// images saved for download are only kept for a day by default, they're the size of the app
+	imageMaxAge := 24 * time.Hour
+	if config.ImageMaxAge != "" {
+		if imageMaxAge, err = time.ParseDuration(config.ImageMaxAge); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	go pruneImages(builderAPI, imageMaxAge)
+	builderAPI.Run()
 }
@@ -4,19 +4,23 @@ import (
 	"atlantis/builder/api/types"
 	"atlantis/builder/build"
 	"atlantis/builder/docker"
+	"atlantis/builder/git"
 	"atlantis/builder/layers"
+	"atlantis/builder/util"
 	"atlantis/common"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"runtime"
 	"sync"
+	"time"
 )
 
 // this will ensure only one build happens at a time
@@ -54,7 +58,25 @@ func (b *Build) Run() {
 	}()
 	defer buildLock.Unlock()
 	b.Status = types.StatusBuilding
-	build.App(b.client, b.URL, b.Sha, b.RelPath, b.manifestDir, layers.ReadLayerInfo(b.layerPath))
+	opts := build.Options{Sparse: b.Sparse, Shallow: b.Shallow, Reproducible: b.Reproducible, NoPush: b.NoPush}
+	if b.OutputFormat != "" {
+		opts.Output, opts.OutputFormat = b.imagePath(), b.OutputFormat
+	}
+	result := build.App(b.client, b.ID, b.URL, b.Sha, b.RelPath, b.manifestDir, layers.ReadLayerInfo(b.layerPath), opts)
+	b.Git = &result.Git
+	b.Image = result.Image
+	b.ContentDigest = result.ContentDigest
+	b.Provenance = result.Provenance
+	b.HealthChecks = result.HealthChecks
+	b.Pushes = result.Pushes
+}
+
+// imagePath is where the image is saved when the build asks for it, a tarball or an OCI layout directory.
+func (b *Build) imagePath() string {
+	if b.OutputFormat == build.OutputOCI {
+		return path.Join(b.manifestDir, "image.oci")
+	}
+	return path.Join(b.manifestDir, "image.tar")
 }
 
 type Boot struct {
@@ -96,11 +118,12 @@ type BuilderAPI struct {
 	Port            uint16
 	LayerPath       string
 	ManifestBaseDir string
+	URLPolicy       *URLPolicy
 }
 
-func New(port uint16, registry, layerPath, manifestBaseDir string) *BuilderAPI {
+func New(port uint16, registry string, mirrors []string, layerPath, manifestBaseDir string) *BuilderAPI {
 	return &BuilderAPI{
-		client:          docker.New(registry),
+		client:          docker.New(registry, mirrors...),
 		builds:          map[string]*Build{},
 		building:        map[string]bool{},
 		Port:            port,
@@ -116,6 +139,10 @@ func (b *BuilderAPI) Run() {
 	r.HandleFunc("/build", b.PostBuildHandler).Methods("POST")
 	r.HandleFunc("/build/{id}", b.GetBuildHandler).Methods("GET")
 	r.HandleFunc("/build/{id}/manifest", b.GetManifestHandler).Methods("GET")
+	r.HandleFunc("/build/{id}/tests", b.GetTestsHandler).Methods("GET")
+	r.HandleFunc("/build/{id}/tests/{file:.+}", b.GetTestFileHandler).Methods("GET")
+	r.HandleFunc("/build/{id}/image", b.GetImageHandler).Methods("GET")
+	r.HandleFunc("/mirror", b.DeleteMirrorHandler).Methods("DELETE")
 	s := &http.Server{
 		Addr:    fmt.Sprintf(":%d", b.Port),
 		Handler: r,
@@ -176,12 +203,36 @@ func (b *BuilderAPI) PostBuildHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error decoding theBuilduest: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	if tbuild.URL == "" || tbuild.Sha == "" || tbuild.RelPath == "" {
-		http.Error(w, "provide url, sha, and rel path!", http.StatusBadRequest)
+	if tbuild.URL == "" || (tbuild.Sha == "" && tbuild.Ref == "") || tbuild.RelPath == "" {
+		http.Error(w, "provide url, sha or ref, and rel path!", http.StatusBadRequest)
+		return
+	}
+	if tbuild.OutputFormat != "" && tbuild.OutputFormat != build.OutputDocker && tbuild.OutputFormat != build.OutputOCI {
+		http.Error(w, "OutputFormat must be docker or oci!", http.StatusBadRequest)
+		return
+	}
+	if b.URLPolicy != nil {
+		if err := b.URLPolicy.Check(tbuild.URL, tbuild.RelPath); err != nil {
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	// the sha names the image and is what builds are deduplicated on, so anything but a full one (a short
+	// sha, or a branch passed as the sha) is resolved first
+	ref := tbuild.Sha
+	if ref == "" {
+		ref = tbuild.Ref
+	}
+	sha, err := git.ResolveRef(tbuild.URL, ref)
+	if err != nil {
+		http.Error(w, "Error resolving ref: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	tbuild.Sha = sha
 
 	tbuild.Status = types.StatusInit
+	tbuild.Git, tbuild.Image, tbuild.ContentDigest, tbuild.Provenance, tbuild.Pushes = nil, nil, "", nil, nil
+	tbuild.HealthChecks = nil
 	theBuild := Build{
 		Build: tbuild,
 	}
@@ -257,6 +308,141 @@ func (b *BuilderAPI) GetManifestHandler(w http.ResponseWriter, r *http.Request)
 	io.Copy(w, manFile)
 }
 
+// GetTestsHandler returns the results.json written by the build's test step. Unlike the manifest it is
+// served for failed builds too, since that's when it's most interesting.
+func (b *BuilderAPI) GetTestsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	b.serveTestFile(w, vars["id"], "results.json")
+}
+
+func (b *BuilderAPI) GetTestFileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	b.serveTestFile(w, vars["id"], vars["file"])
+}
+
+func (b *BuilderAPI) serveTestFile(w http.ResponseWriter, id, file string) {
+	b.RLock()
+	defer b.RUnlock()
+	theBuild := b.builds[id]
+	if theBuild == nil {
+		http.Error(w, "No such build", http.StatusNotFound)
+		return
+	}
+	if theBuild.Status != types.StatusDone && theBuild.Status != types.StatusError {
+		http.Error(w, "Build Not Finished", http.StatusBadRequest)
+		return
+	}
+	testFile, err := os.Open(path.Join(theBuild.manifestDir, "tests", path.Clean("/"+file)))
+	if os.IsNotExist(err) {
+		http.Error(w, "No test results", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer testFile.Close()
+	io.Copy(w, testFile)
+}
+
+// GetImageHandler downloads the image of a build that asked for OutputFormat: the docker save tarball, or
+// the OCI image layout directory as a tarball.
+func (b *BuilderAPI) GetImageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	b.RLock()
+	theBuild := b.builds[vars["id"]]
+	b.RUnlock()
+	if theBuild == nil {
+		http.Error(w, "No such build", http.StatusNotFound)
+		return
+	}
+	if theBuild.Status == types.StatusError {
+		http.Error(w, "Build Ended with Error", http.StatusBadRequest)
+		return
+	}
+	if theBuild.Status != types.StatusDone {
+		http.Error(w, "Build Not Finished", http.StatusBadRequest)
+		return
+	}
+	if theBuild.OutputFormat == "" {
+		http.Error(w, "Build did not save its image", http.StatusNotFound)
+		return
+	}
+
+	imageLock.RLock()
+	defer imageLock.RUnlock()
+	imagePath := theBuild.imagePath()
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		http.Error(w, "Build's image has expired", http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s.tar", theBuild.ID, theBuild.OutputFormat))
+	if theBuild.OutputFormat == build.OutputOCI {
+		if err := util.WriteTar(w, imagePath); err != nil {
+			log.Printf("Error sending image of build %s: %v", theBuild.ID, err)
+		}
+		return
+	}
+	imageFile, err := os.Open(imagePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer imageFile.Close()
+	io.Copy(w, imageFile)
+}
+
+// imageLock keeps PruneImages from deleting images while they're downloaded.
+var imageLock = sync.RWMutex{}
+
+// PruneImages deletes the images builds saved for download that are older than maxAge, and returns the IDs
+// of the builds they were from. Everything else the builds left in their manifest dirs is kept.
+func (b *BuilderAPI) PruneImages(maxAge time.Duration) ([]string, error) {
+	imageLock.Lock()
+	defer imageLock.Unlock()
+	pruned := []string{}
+	dirs, err := ioutil.ReadDir(b.ManifestBaseDir)
+	if err != nil {
+		return pruned, err
+	}
+	for _, dir := range dirs {
+		for _, name := range []string{"image.tar", "image.oci"} {
+			imagePath := path.Join(b.ManifestBaseDir, dir.Name(), name)
+			info, err := os.Stat(imagePath)
+			if err != nil || time.Since(info.ModTime()) < maxAge {
+				continue
+			}
+			if err := os.RemoveAll(imagePath); err != nil {
+				return pruned, err
+			}
+			pruned = append(pruned, dir.Name())
+		}
+	}
+	return pruned, nil
+}
+
+// DeleteMirrorHandler drops the git mirror of the repository given by the url query parameter, so the
+// next build of it clones from scratch.
+func (b *BuilderAPI) DeleteMirrorHandler(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "provide url!", http.StatusBadRequest)
+		return
+	}
+	if err := git.DropMirror(url); os.IsNotExist(err) {
+		http.Error(w, "No such mirror", http.StatusNotFound)
+		return
+	} else if err == git.ErrMirrorsDisabled {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (b *BuilderAPI) reserveBuild(r *Build) error {
 	b.Lock()
 	defer b.Unlock()
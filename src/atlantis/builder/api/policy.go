@@ -0,0 +1,167 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// RepoRule overrides the URLPolicy for one repository. A rule with Allow unset only restricts the rel paths
+// that may be built from the repository.
+type RepoRule struct {
+	URL      string   `toml:"url"`
+	Allow    *bool    `toml:"allow"`
+	RelPaths []string `toml:"rel_paths"`
+}
+
+// URLPolicy decides which repositories builderd builds. A remote URL is allowed if its host is one of
+// AllowedHosts ("*.example.com" matches subdomains) or the whole URL matches one of the AllowedPatterns
+// regexps, which are anchored at both ends, or if neither is configured. Local repositories, given as
+// file:// URLs or as plain paths, are only allowed with AllowFile and only below FileRoots.
+type URLPolicy struct {
+	AllowedHosts    []string   `toml:"allowed_hosts"`
+	AllowedPatterns []string   `toml:"allowed_patterns"`
+	AllowFile       bool       `toml:"allow_file"`
+	FileRoots       []string   `toml:"file_roots"`
+	Repos           []RepoRule `toml:"repos"`
+
+	patterns []*regexp.Regexp
+}
+
+// Compile checks the policy's patterns. It has to be called before the policy is used.
+func (p *URLPolicy) Compile() error {
+	p.patterns = []*regexp.Regexp{}
+	for _, pattern := range p.AllowedPatterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid allowed pattern %s: %s", pattern, err.Error()))
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	for idx, root := range p.FileRoots {
+		if !filepath.IsAbs(root) {
+			return errors.New(fmt.Sprintf("Invalid file root %s! File roots must be absolute.", root))
+		}
+		p.FileRoots[idx] = filepath.Clean(root)
+	}
+	return nil
+}
+
+func normalizeURL(repoURL string) string {
+	return strings.TrimSuffix(strings.TrimRight(repoURL, "/"), ".git")
+}
+
+// urlHost returns the host of both proper URLs and scp like ones such as git@github.com:ooyala/atlantis.
+func urlHost(repoURL string) string {
+	if strings.Contains(repoURL, "://") {
+		if u, err := url.Parse(repoURL); err == nil {
+			return strings.Split(u.Host, ":")[0]
+		}
+		return ""
+	}
+	host := strings.SplitN(repoURL, ":", 2)[0]
+	if idx := strings.LastIndex(host, "@"); idx >= 0 {
+		host = host[idx+1:]
+	}
+	return host
+}
+
+func (p *URLPolicy) hostAllowed(host string) bool {
+	for _, allowed := range p.AllowedHosts {
+		if allowed == host || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// localPath returns the path of a repository on the local disk, which is what git takes a file:// URL or
+// anything without a scheme and without an scp like host: before its first slash to be.
+func localPath(repoURL string) (string, bool) {
+	if strings.HasPrefix(repoURL, "file://") {
+		return strings.TrimPrefix(repoURL, "file://"), true
+	}
+	if strings.Contains(repoURL, "://") {
+		return "", false
+	}
+	colon, slash := strings.Index(repoURL, ":"), strings.Index(repoURL, "/")
+	if colon >= 0 && (slash < 0 || colon < slash) {
+		return "", false
+	}
+	return repoURL, true
+}
+
+func (p *URLPolicy) fileAllowed(localPath string) error {
+	if !p.AllowFile {
+		return errors.New("local repositories are not allowed")
+	}
+	dir, err := filepath.Abs(localPath)
+	if err != nil {
+		return err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return err
+	}
+	for _, root := range p.FileRoots {
+		if dir == root || strings.HasPrefix(dir, root+"/") {
+			return nil
+		}
+	}
+	return errors.New(dir + " is not below an allowed file root")
+}
+
+// Check returns why building relPath from repoURL isn't allowed, or nil if it is. A repo rule can allow a
+// remote repository that isn't otherwise allowed, but a local one still has to pass the file rules.
+func (p *URLPolicy) Check(repoURL, relPath string) error {
+	dir, local := localPath(repoURL)
+	for _, rule := range p.Repos {
+		if normalizeURL(rule.URL) != normalizeURL(repoURL) {
+			continue
+		}
+		if rule.Allow != nil && !*rule.Allow {
+			return errors.New(repoURL + " is not allowed")
+		}
+		if len(rule.RelPaths) > 0 {
+			allowed := false
+			for _, rel := range rule.RelPaths {
+				allowed = allowed || filepath.Clean(rel) == filepath.Clean(relPath)
+			}
+			if !allowed {
+				return errors.New(relPath + " may not be built from " + repoURL)
+			}
+		}
+		if rule.Allow != nil && !local {
+			return nil
+		}
+	}
+
+	if local {
+		return p.fileAllowed(dir)
+	}
+	if len(p.AllowedHosts) == 0 && len(p.patterns) == 0 {
+		return nil
+	}
+	if p.hostAllowed(urlHost(repoURL)) {
+		return nil
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(repoURL) {
+			return nil
+		}
+	}
+	return errors.New(repoURL + " does not match an allowed host or pattern")
+}
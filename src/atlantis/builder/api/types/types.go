@@ -1,5 +1,11 @@
 package types
 
+import (
+	"atlantis/builder/docker"
+	"atlantis/builder/git"
+	"atlantis/builder/manifest"
+)
+
 const (
 	StatusInit     = "INIT"
 	StatusDone     = "DONE"
@@ -11,10 +17,23 @@ const (
 type Build struct {
 	ID      string
 	URL     string
+	Ref     string `json:",omitempty"`
 	Sha     string
 	RelPath string
+	Sparse  bool `json:",omitempty"`
+	Shallow bool `json:",omitempty"`
 	Status  string
 	Error   interface{}
+	Git     *git.Info     `json:",omitempty"`
+	Image   *docker.Image `json:",omitempty"`
+
+	Reproducible  bool                   `json:",omitempty"`
+	ContentDigest string                 `json:",omitempty"`
+	Provenance    interface{}            `json:",omitempty"`
+	HealthChecks  []manifest.HealthCheck `json:",omitempty"`
+	OutputFormat  string                 `json:",omitempty"`
+	NoPush        bool                   `json:",omitempty"`
+	Pushes        []docker.PushResult    `json:",omitempty"`
 }
 
 type Boot struct {
@@ -36,48 +36,28 @@ import (
 // NOTE(manas) This programs panics in places you'd expect it to call log.Fatal(). The panic allows
 // the deferred clean up functions in main() to execute before the program dies.
 
+// DefaultLogForward is where app logs are shipped when the manifest doesn't declare [logging.forward].
+var DefaultLogForward *manifest.LogForward
+
 func copyApp(overlayDir, sourceDir string) string {
 	appDir := path.Join(overlayDir, "/src")
-	if err := os.MkdirAll(appDir, 0700); err != nil {
-		panic(err)
-	}
-
-	walk := func(path string, info os.FileInfo, err error) error {
-		// don't copy the git store
-		if strings.Contains(path, "/.git") {
-			return nil
-		}
-
-		target := strings.Replace(path, sourceDir, appDir, 1)
-		if info.IsDir() {
-			return os.MkdirAll(target, 0700)
-		} else {
-			src, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer src.Close()
 
-			dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE, info.Mode())
-			if err != nil {
-				return err
-			}
-			defer dst.Close()
+	ignores := readIgnoreFile(sourceDir)
+	fmt.Printf("Ignoring when copying the app: %v\n", ignores.Patterns())
 
-			if _, err := io.Copy(dst, src); err != nil {
-				return err
-			}
-		}
-		return nil
+	skip := func(relPath string, info os.FileInfo) bool {
+		// don't copy the git store, nor a submodule's pointer to it
+		return info.Name() == ".git" || ignores.ignored(relPath, info.IsDir())
 	}
-	if err := filepath.Walk(sourceDir, walk); err != nil {
+	if err := util.CopyTree(sourceDir, appDir, skip); err != nil {
 		panic(err)
 	}
 
 	return appDir
 }
 
-func writeConfigs(overlayDir string, manifest *manifest.Data) {
+func writeConfigs(overlayDir string, manifest *manifest.Data, sha string) {
+	logInfo := template.LogInfo{App: manifest.Name, Sha: sha, Format: manifest.LogFormat, Rotation: manifest.LogRotation}
 	for idx, cmd := range manifest.RunCommands {
 		// create /etc/sv/app0
 		relPath := fmt.Sprintf("/etc/sv/app%d", idx)
@@ -96,11 +76,22 @@ func writeConfigs(overlayDir string, manifest *manifest.Data) {
 		panic(err)
 	}
 
+	// write /etc/rsyslog.d/00-forward.conf, the manifest's forwarding replaces the server default
+	logForward := manifest.LogForward
+	if logForward == nil {
+		logForward = DefaultLogForward
+	}
+	if logForward != nil && !logForward.Disabled {
+		template.WriteRsyslogForwardConfig(path.Join(overlayDir, "/etc/rsyslog.d/00-forward.conf"), logForward, logInfo)
+	}
+
+	logDirs := []string{}
 	for idx := range manifest.RunCommands {
 		// write /etc/rsyslog.d/local0.conf
 		relPath := fmt.Sprintf("/etc/rsyslog.d/49-app%d.conf", idx)
 		absPath := path.Join(overlayDir, relPath)
-		template.WriteRsyslogAppConfig(absPath, idx)
+		template.WriteRsyslogAppConfig(absPath, idx, logInfo)
+		logDirs = append(logDirs, fmt.Sprintf("app%d", idx))
 	}
 
 	numCmds := len(manifest.RunCommands)
@@ -122,13 +113,17 @@ func writeConfigs(overlayDir string, manifest *manifest.Data) {
 				}
 				relPath := fmt.Sprintf("/etc/rsyslog.d/%s.conf", val["name"])
 				absPath := path.Join(overlayDir, relPath)
-				template.WriteRsyslogCustomConfig(absPath, key, val)
+				logDirs = append(logDirs, val["name"])
+				template.WriteRsyslogCustomConfig(absPath, key, val, logInfo)
 			} else {
 				panic(errors.New(fmt.Sprintf("Invalid custom facility specified! Facility must be in %s, but was declared as %s.", facString, key)))
 			}
 		}
 	}
 
+	// write /etc/logrot.conf, overriding the one in the base layer, and a config per log directory
+	template.WriteLogrotateConfigs(overlayDir, logDirs, manifest.LogRotation)
+
 	// create /etc/atlantis/scripts
 	if err := os.MkdirAll(path.Join(overlayDir, "/etc/atlantis/scripts"), 0700); err != nil {
 		panic(err)
@@ -136,9 +131,17 @@ func writeConfigs(overlayDir string, manifest *manifest.Data) {
 
 	absPath := path.Join(overlayDir, "/etc/atlantis/scripts/setup")
 	template.WriteSetupScript(absPath, manifest)
+
+	// write /etc/atlantis/scripts/health_check and its description in /etc/atlantis/info
+	absPath = path.Join(overlayDir, "/etc/atlantis/scripts/health_check")
+	template.WriteHealthCheckScript(absPath, manifest.Name, manifest.HealthChecks)
+	if err := os.MkdirAll(path.Join(overlayDir, "/etc/atlantis/info"), 0755); err != nil {
+		panic(err)
+	}
+	template.WriteHealthCheckInfo(path.Join(overlayDir, "/etc/atlantis/info/health_checks.json"), manifest.HealthChecks)
 }
 
-func writeInfo(overlayDir string, gitInfo git.Info) {
+func writeInfo(overlayDir string, gitInfo git.Info, built time.Time) {
 	infoDir := path.Join(overlayDir, "/etc/atlantis/info")
 	if err := os.MkdirAll(infoDir, 0755); err != nil {
 		panic(err)
@@ -153,7 +156,7 @@ func writeInfo(overlayDir string, gitInfo git.Info) {
 		panic(err)
 	}
 
-	timestr := time.Now().UTC().Format(time.RFC822)
+	timestr := built.UTC().Format(time.RFC822)
 	if err := ioutil.WriteFile(path.Join(infoDir, "build_utc"), []byte(timestr), 0644); err != nil {
 		panic(err)
 	}
@@ -211,8 +214,110 @@ func copyManifest(manifestDir, fname string) {
 	io.Copy(copyFile, manFile)
 }
 
-func App(client *docker.Client, buildURL, buildSha, relPath, manifestDir string, l *layers.Layers) {
+// Options are the per build settings that don't change what is built. Sparse only checks out the rel path
+// and the manifest's source_paths, Shallow only fetches the sha being built where the remote allows it.
+// Reproducible dates everything in the app's layer to the commit and reports a digest of its content, so
+// builds of the same sha on different builders can be checked to be identical. Output, if set, is where the
+// image is saved in OutputFormat, and NoPush keeps it off the registry.
+type Options struct {
+	Sparse       bool
+	Shallow      bool
+	Reproducible bool
+	Output       string
+	OutputFormat string
+	NoPush       bool
+}
+
+const (
+	OutputDocker = "docker"
+	OutputOCI    = "oci"
+)
+
+// exportImage saves image to output, as a docker save tarball or, for OutputOCI, an OCI image layout
+// directory.
+func exportImage(client *docker.Client, image, output, format string) {
+	fmt.Printf("Saving %s to %s (%s)\n", image, output, format)
+	tarball := output
+	if format == OutputOCI {
+		tarball = output + ".tar"
+		defer os.Remove(tarball)
+	} else if format != OutputDocker && format != "" {
+		panic("unknown output format " + format)
+	}
+
+	fh, err := os.Create(tarball)
+	if err != nil {
+		panic(err)
+	}
+	err = client.SaveImage(image, fh)
+	fh.Close()
+	if err != nil {
+		os.Remove(tarball)
+		panic(err)
+	}
+
+	if format == OutputOCI {
+		if err := docker.WriteOCILayout(tarball, output, image); err != nil {
+			os.RemoveAll(output)
+			panic(err)
+		}
+	}
+}
+
+// Result is what App reports back about a finished build. Image is the app image built, or found to already
+// exist. ContentDigest is only set for reproducible builds, Pushes has how pushing the image to each
+// registry went.
+type Result struct {
+	Git           git.Info
+	Image         *docker.Image
+	ContentDigest string
+	Provenance    *Provenance
+	HealthChecks  []manifest.HealthCheck
+	Pushes        []docker.PushResult
+}
+
+// sourceDate is the commit date of the sha being built, what reproducible builds use instead of the time.
+func sourceDate(gitInfo git.Info) time.Time {
+	date, err := time.Parse(time.RFC3339, gitInfo.Date)
+	if err != nil {
+		panic("no commit date to build reproducibly from: " + err.Error())
+	}
+	return date
+}
+
+// The most of the reproducible build script's digest and content listing that's read.
+const (
+	maxDigestSize  = 1 << 10
+	maxContentSize = 64 << 20
+)
+
+// readContentDigest picks up what the reproducible build script left in the overlay and keeps the listing
+// the digest is over next to the manifest, to compare against another builder's when the digests differ.
+// The build's container wrote them, so only a real directory of regular files is read, and only so much.
+func readContentDigest(overlayDir, manifestDir string) string {
+	stateDir := path.Join(overlayDir, ".reproducible")
+	if info, err := os.Lstat(stateDir); err != nil {
+		panic(err)
+	} else if !info.IsDir() {
+		panic(stateDir + " is not a directory")
+	}
+	digest, err := util.ReadRegularFile(path.Join(stateDir, "digest"), maxDigestSize)
+	if err != nil {
+		panic(err)
+	}
+	content, err := util.ReadRegularFile(path.Join(stateDir, "content.txt"), maxContentSize)
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path.Join(manifestDir, "content.txt"), content, 0644); err != nil {
+		panic(err)
+	}
+	return "sha256:" + strings.TrimSpace(string(digest))
+}
+
+func App(client *docker.Client, buildID, buildURL, buildSha, relPath, manifestDir string, l *layers.Layers, opts Options) *Result {
 	fmt.Printf("Building app: %v %v %v\n", buildURL, buildSha, relPath)
+	started := time.Now().UTC()
 	usr, err := user.Current()
 	if err != nil {
 		panic(err)
@@ -225,7 +330,11 @@ func App(client *docker.Client, buildURL, buildSha, relPath, manifestDir string,
 	defer os.RemoveAll(cloneDir)
 
 	fmt.Printf("Checking out: %v %v %v\n", buildURL, buildSha, cloneDir)
-	gitInfo := git.Checkout(buildURL, buildSha, cloneDir)
+	checkoutOpts := git.CheckoutOptions{Shallow: opts.Shallow}
+	if opts.Sparse {
+		checkoutOpts.SparsePaths = []string{relPath}
+	}
+	gitInfo := git.Checkout(buildURL, buildSha, cloneDir, checkoutOpts)
 	fmt.Printf("Checked out: %v %v %v\n", buildURL, buildSha, cloneDir)
 
 	sourceDir := path.Join(cloneDir, relPath)
@@ -240,12 +349,25 @@ func App(client *docker.Client, buildURL, buildSha, relPath, manifestDir string,
 	if err != nil {
 		panic(err)
 	}
+	if len(gitInfo.Sparse) > 0 && len(manifest.SourcePaths) > 0 {
+		fmt.Printf("Widening sparse checkout: %v\n", append(gitInfo.Sparse, manifest.SourcePaths...))
+		gitInfo.Sparse = git.SparseCheckout(cloneDir, append(gitInfo.Sparse, manifest.SourcePaths...))
+	}
+	if manifest.GitLFS {
+		fmt.Printf("Fetching Git LFS objects\n")
+		git.FetchLFS(cloneDir, gitInfo.Sparse)
+		gitInfo.LFS = true
+	}
+	result := &Result{Git: gitInfo, HealthChecks: manifest.HealthChecks}
 	copyManifest(manifestDir, manifestFname)
+	// next to the manifest, so what probes the app doesn't have to run its image to find out how
+	template.WriteHealthCheckInfo(path.Join(manifestDir, "health_checks.json"), manifest.HealthChecks)
 
 	builderLayer, err := l.BuilderLayerName(manifest.AppType)
 	if err != nil {
 		panic(err)
 	}
+	containerOpts := BuildLimits.containerOptions(manifest.Build)
 
 	overlayDir, err := ioutil.TempDir(usr.HomeDir, manifest.Name)
 	if err != nil {
@@ -257,23 +379,94 @@ func App(client *docker.Client, buildURL, buildSha, relPath, manifestDir string,
 
 	appDockerName := fmt.Sprintf("apps/%s-%s", manifest.Name, gitInfo.Sha)
 
-	if client.ImageExists(appDockerName) {
+	if exists, err := client.ImageExists(appDockerName); !exists {
+		fmt.Printf("No existing image: %s\n", err)
+	} else {
 		if os.Getenv("REBUILD_IMAGE") == "" {
-			fmt.Println("Image exists!\n")
-			return
+			fmt.Println("Image exists!")
+			image := client.InspectImage(appDockerName)
+			result.Image = &image
+			if opts.Output != "" {
+				exportImage(client, appDockerName, opts.Output, opts.OutputFormat)
+			}
+			return result
 		}
 	}
 
-	if !client.ImageExists(builderLayer) {
-		panic("Builder layer doesn't exist: " + builderLayer)
+	if exists, err := client.ImageExists(builderLayer); !exists {
+		panic(fmt.Sprintf("Builder layer %s doesn't exist: %s", builderLayer, err))
+	}
+
+	if len(manifest.TestCommands) > 0 {
+		runTests(client, builderLayer, sourceDir, manifestDir, manifest, containerOpts)
 	}
 
-	writeInfo(overlayDir, gitInfo)
-	writeConfigs(overlayDir, manifest)
+	hostname, err := os.Hostname()
+	if err != nil {
+		panic(err)
+	}
+	prov := &Provenance{
+		App:            manifest.Name,
+		Sha:            gitInfo.Sha,
+		URL:            buildURL,
+		RelPath:        relPath,
+		BuilderLayer:   builderLayer,
+		BuilderVersion: l.Version,
+		BuilderHost:    hostname,
+		BuildID:        buildID,
+		StartedUTC:     started.Format(time.RFC3339),
+		ManifestSha256: fileSha256(manifestFname),
+	}
+
+	built := started
+	imageProv := *prov
+	runScript := []string{"/etc/atlantis/scripts/build", "/overlay"}
+	if opts.Reproducible {
+		// the image and its labels get nothing that differs between builders, the manifest dir's copy
+		// still says where it's from
+		built = sourceDate(gitInfo)
+		imageProv.StartedUTC = built.Format(time.RFC3339)
+		imageProv.BuilderHost = ""
+		imageProv.BuildID = ""
+		imageProv.Reproducible = true
+
+		stateDir := path.Join(overlayDir, ".reproducible")
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			panic(err)
+		}
+		template.WriteReproducibleScript(path.Join(stateDir, "build"), manifest.Name)
+		runScript = append([]string{"/overlay/.reproducible/build"}, runScript...)
+		containerOpts.Env = append(containerOpts.Env, fmt.Sprintf("SOURCE_DATE_EPOCH=%d", built.Unix()))
+		fmt.Printf("Building reproducibly as of %v\n", imageProv.StartedUTC)
+	}
+
+	writeInfo(overlayDir, gitInfo, built)
+	writeProvenance(path.Join(overlayDir, "/etc/atlantis/info"), &imageProv)
+	writeConfigs(overlayDir, manifest, gitInfo.Sha)
 
 	if strings.HasPrefix(manifest.AppType, "java") {
 		runJavaPrebuild(appDir, manifest.AppType, manifest.JavaType)
 	}
-	client.OverlayAndCommit(builderLayer, appDockerName, overlayDir, "/overlay", 5*time.Minute, "/etc/atlantis/scripts/build", "/overlay")
-	client.PushImage(appDockerName, true)
+	if containerOpts.Isolated {
+		fmt.Printf("Building without network access other than to %v\n", containerOpts.Proxies)
+	}
+	image := client.OverlayAndCommit(builderLayer, appDockerName, overlayDir, "/overlay", imageProv.Labels(), containerOpts, 5*time.Minute, runScript...)
+	result.Image = &image
+	prov.FinishedUTC = time.Now().UTC().Format(time.RFC3339)
+	writeProvenance(manifestDir, prov)
+	result.Provenance = prov
+	if opts.Reproducible {
+		result.ContentDigest = readContentDigest(overlayDir, manifestDir)
+		fmt.Printf("Content digest: %v\n", result.ContentDigest)
+	}
+	if manifest.SmokeTest.Enabled {
+		smokeTest(client, appDockerName, manifest, containerOpts)
+	}
+	if opts.Output != "" {
+		exportImage(client, appDockerName, opts.Output, opts.OutputFormat)
+	}
+	if !opts.NoPush {
+		result.Pushes = client.PushImageToAll(appDockerName, true)
+	}
+	return result
 }
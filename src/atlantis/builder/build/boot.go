@@ -29,11 +29,11 @@ func Boot(client *docker.Client, overlayDir string, l *layers.Layers) {
 		wg.Add(1)
 		go func(myType string) {
 			fmt.Printf("\tstart %s -> %s\n", l.BaseLayerName(), l.BuilderLayerNameUnsafe(myType))
-			client.OverlayAndCommit(l.BaseLayerName(), l.BuilderLayerNameUnsafe(myType),
-				path.Join(builderLayers, myType), "/overlay", 100*time.Minute, "/overlay/sbin/provision_type",
+			image := client.OverlayAndCommit(l.BaseLayerName(), l.BuilderLayerNameUnsafe(myType),
+				path.Join(builderLayers, myType), "/overlay", nil, docker.ContainerOptions{Privileged: true}, 100*time.Minute, "/overlay/sbin/provision_type",
 				"/overlay")
 			client.PushImage(l.BuilderLayerNameUnsafe(myType), false)
-			fmt.Printf("\tdone %s\n ", l.BuilderLayerNameUnsafe(myType))
+			fmt.Printf("\tdone %s %s\n ", l.BuilderLayerNameUnsafe(myType), image.ID)
 			wg.Done()
 		}(appType)
 	}
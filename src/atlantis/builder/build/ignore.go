@@ -0,0 +1,151 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package build
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile lists, in gitignore syntax, the paths under the app's rel path that aren't copied into the
+// overlay. Git's own .git directories and files are never copied.
+const IgnoreFile = ".atlantisignore"
+
+type ignoreRule struct {
+	pattern string
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreList is the rules of an IgnoreFile in order. Like in git the last rule matching a path decides.
+type ignoreList []ignoreRule
+
+// readIgnoreFile reads the IgnoreFile in dir. There are no rules when dir doesn't have one.
+func readIgnoreFile(dir string) ignoreList {
+	file, err := os.Open(path.Join(dir, IgnoreFile))
+	if os.IsNotExist(err) {
+		return ignoreList{}
+	} else if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	rules := ignoreList{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	// trailing spaces don't count unless they're escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{pattern: line}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	// a pattern with a slash other than at its end is relative to the app's root, otherwise it matches
+	// at any depth
+	expr := "^"
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		expr += "(?:.*/)?"
+	}
+	expr += globToRegex(line) + "$"
+	rule.regex = regexp.MustCompile(expr)
+	return rule, true
+}
+
+// globToRegex translates a gitignore glob, where only ** matches across slashes.
+func globToRegex(glob string) string {
+	expr := ""
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			expr += "(?:.*/)?"
+			i += 2
+		case glob[i:] == "**" && i > 0 && glob[i-1] == '/':
+			expr += ".*"
+			i++
+		case c == '*':
+			expr += "[^/]*"
+		case c == '?':
+			expr += "[^/]"
+		case c == '[' && strings.Index(glob[i+1:], "]") > 0:
+			end := i + 1 + strings.Index(glob[i+1:], "]")
+			class := glob[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "[" + strings.Replace(class, "\\", "\\\\", -1) + "]"
+			i = end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr += regexp.QuoteMeta(glob[i : i+1])
+		default:
+			expr += regexp.QuoteMeta(glob[i : i+1])
+		}
+	}
+	return expr
+}
+
+// ignored says whether relPath, relative to the app's root and slash separated, is ignored.
+func (l ignoreList) ignored(relPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range l {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.regex.MatchString(relPath) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// Patterns returns the effective ignore list, the implicit .git first.
+func (l ignoreList) Patterns() []string {
+	patterns := []string{".git"}
+	for _, rule := range l {
+		patterns = append(patterns, rule.pattern)
+	}
+	return patterns
+}
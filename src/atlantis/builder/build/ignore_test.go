@@ -0,0 +1,114 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+type ignoreCase struct {
+	name  string
+	rules []string
+	path  string
+	isDir bool
+	want  bool
+}
+
+var ignoreCases = []ignoreCase{
+	// plain names match at any depth
+	{"name at the root", []string{"*.log"}, "out.log", false, true},
+	{"name in a subdirectory", []string{"*.log"}, "a/b/out.log", false, true},
+	{"name doesn't match a prefix", []string{"*.log"}, "out.log.gz", false, false},
+	{"star stays in its component", []string{"a*"}, "a/b", false, false},
+	{"question mark is one character", []string{"?.txt"}, "a.txt", false, true},
+	{"question mark isn't a slash", []string{"a?b"}, "a/b", false, false},
+	{"character class", []string{"[ab].txt"}, "b.txt", false, true},
+	{"negated character class", []string{"[!ab].txt"}, "a.txt", false, false},
+
+	// negation
+	{"negation re-includes", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+	{"negation leaves the rest", []string{"*.log", "!keep.log"}, "drop.log", false, true},
+	{"last matching rule wins", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+	{"negation alone ignores nothing", []string{"!keep.log"}, "keep.log", false, false},
+
+	// **
+	{"leading ** matches at the root", []string{"**/cache"}, "cache", true, true},
+	{"leading ** matches at any depth", []string{"**/cache"}, "a/b/cache", true, true},
+	{"trailing ** matches everything inside", []string{"build/**"}, "build/a/b.o", false, true},
+	{"trailing ** doesn't match the directory", []string{"build/**"}, "build", true, false},
+	{"inner ** matches no directories", []string{"a/**/b"}, "a/b", false, true},
+	{"inner ** matches several directories", []string{"a/**/b"}, "a/x/y/b", false, true},
+	{"inner ** is anchored", []string{"a/**/b"}, "c/a/x/b", false, false},
+	{"** in a component is a star", []string{"a**b"}, "a/b", false, false},
+
+	// leading / anchors
+	{"leading slash matches at the root", []string{"/tmp"}, "tmp", true, true},
+	{"leading slash doesn't match deeper", []string{"/tmp"}, "src/tmp", true, false},
+	{"inner slash anchors too", []string{"docs/build"}, "docs/build", true, true},
+	{"inner slash doesn't match deeper", []string{"docs/build"}, "src/docs/build", true, false},
+
+	// trailing / only matches directories
+	{"dir-only matches a directory", []string{"logs/"}, "logs", true, true},
+	{"dir-only matches a directory at any depth", []string{"logs/"}, "a/logs", true, true},
+	{"dir-only doesn't match a file", []string{"logs/"}, "logs", false, false},
+	{"anchored dir-only", []string{"/logs/"}, "a/logs", true, false},
+	{"negated dir-only leaves files alone", []string{"logs", "!logs/"}, "logs", false, true},
+
+	// escapes
+	{"escaped bang is a name", []string{"\\!important"}, "!important", false, true},
+	{"escaped hash is a name", []string{"\\#notes"}, "#notes", false, true},
+	{"escaped star is literal", []string{"a\\*b"}, "a*b", false, true},
+	{"escaped star doesn't glob", []string{"a\\*b"}, "axb", false, false},
+	{"escaped question mark is literal", []string{"what\\?"}, "whatx", false, false},
+	{"escaped trailing space is kept", []string{"name\\ "}, "name ", false, true},
+	{"unescaped trailing space is dropped", []string{"name  "}, "name", false, true},
+	{"regex characters are literal", []string{"a.b+c"}, "axb+c", false, false},
+}
+
+func TestIgnored(t *testing.T) {
+	for _, c := range ignoreCases {
+		rules := ignoreList{}
+		for _, line := range c.rules {
+			if rule, ok := parseIgnoreRule(line); ok {
+				rules = append(rules, rule)
+			}
+		}
+		if got := rules.ignored(c.path, c.isDir); got != c.want {
+			t.Errorf("%s: %q with %q (dir %v) ignored %v, expected %v", c.name, c.path, c.rules, c.isDir, got, c.want)
+		}
+	}
+}
+
+func TestReadIgnoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if rules := readIgnoreFile(dir); len(rules) != 0 {
+		t.Errorf("rules without an ignore file: %v", rules.Patterns())
+	}
+
+	content := "# comment\n\n*.log\n   \n!keep.log\n/\n"
+	if err := ioutil.WriteFile(path.Join(dir, IgnoreFile), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{".git", "*.log", "!keep.log"}
+	if patterns := readIgnoreFile(dir).Patterns(); !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("read %v, expected %v", patterns, expected)
+	}
+}
@@ -0,0 +1,103 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package build
+
+import (
+	"atlantis/builder/docker"
+	"atlantis/builder/manifest"
+	"fmt"
+)
+
+// Limits are what app build containers may use. The defaults apply when the manifest's [build] table
+// doesn't ask for something else, and the maxima bound what it can ask for. Zero means unlimited, and a
+// default of zero under a maximum is the maximum. MemoryLimit and MaxMemoryLimit are in MB.
+//
+// Unprivileged builds everything unprivileged, otherwise manifests can opt out. IsolateNetwork cuts every
+// build off from everything but the DependencyProxies, otherwise manifests can opt in. Isolated builds are
+// always unprivileged, since a privileged container could lift its own isolation.
+type Limits struct {
+	CPUShares         uint     `toml:"cpu_shares"`
+	MaxCPUShares      uint     `toml:"max_cpu_shares"`
+	MemoryLimit       uint     `toml:"memory_limit"`
+	MaxMemoryLimit    uint     `toml:"max_memory_limit"`
+	PidsLimit         uint     `toml:"pids_limit"`
+	MaxPidsLimit      uint     `toml:"max_pids_limit"`
+	Unprivileged      bool     `toml:"unprivileged"`
+	IsolateNetwork    bool     `toml:"isolate_network"`
+	DependencyProxies []string `toml:"dependency_proxies"`
+}
+
+// BuildLimits are the limits of every app build. The zero value is how builds always ran: privileged,
+// unlimited and on the network.
+var BuildLimits = &Limits{}
+
+func (l *Limits) Validate() error {
+	bounds := []struct {
+		name         string
+		def, maximum uint
+	}{
+		{"cpu_shares", l.CPUShares, l.MaxCPUShares},
+		{"memory_limit", l.MemoryLimit, l.MaxMemoryLimit},
+		{"pids_limit", l.PidsLimit, l.MaxPidsLimit},
+	}
+	for _, b := range bounds {
+		if b.maximum != 0 && b.def > b.maximum {
+			return fmt.Errorf("build limit %s %d is more than max_%s %d", b.name, b.def, b.name, b.maximum)
+		}
+	}
+	for _, proxy := range l.DependencyProxies {
+		if _, err := docker.ProxyAddress(proxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limit is what the manifest asked for, else the default, else the maximum. Asking for more than the
+// maximum fails the build.
+func limit(name string, asked, def, maximum uint) int64 {
+	if maximum != 0 && asked > maximum {
+		panic(fmt.Sprintf("manifest build.%s %d is more than the builder allows: %d", name, asked, maximum))
+	}
+	if asked == 0 {
+		asked = def
+	}
+	if asked == 0 {
+		asked = maximum
+	}
+	return int64(asked)
+}
+
+// containerOptions are the options to build an app with whose manifest asks for res.
+func (l *Limits) containerOptions(res manifest.BuildResources) docker.ContainerOptions {
+	opts := docker.ContainerOptions{
+		CPUShares:  limit("cpu_shares", res.CPUShares, l.CPUShares, l.MaxCPUShares),
+		Memory:     limit("memory_limit", res.MemoryLimit, l.MemoryLimit, l.MaxMemoryLimit) * 1024 * 1024,
+		PidsLimit:  limit("pids_limit", res.PidsLimit, l.PidsLimit, l.MaxPidsLimit),
+		Privileged: !l.Unprivileged,
+		Isolated:   l.IsolateNetwork || res.IsolateNetwork,
+		Proxies:    l.DependencyProxies,
+	}
+	if res.Privileged != nil {
+		if *res.Privileged && l.Unprivileged {
+			panic("manifest build.privileged is set but the builder only builds unprivileged")
+		}
+		if *res.Privileged && opts.Isolated {
+			panic("manifest build.privileged is set but isolated builds are unprivileged")
+		}
+		opts.Privileged = *res.Privileged
+	}
+	if opts.Isolated {
+		opts.Privileged = false
+	}
+	return opts
+}
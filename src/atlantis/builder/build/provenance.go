@@ -0,0 +1,130 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// ProvenanceKey signs the provenance document written into every app image. Images are built without a
+// signature when it's nil.
+var ProvenanceKey *rsa.PrivateKey
+
+// LoadProvenanceKey reads a PEM encoded RSA private key into ProvenanceKey.
+func LoadProvenanceKey(fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("no PEM data found in " + fname)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	ProvenanceKey = key
+	return nil
+}
+
+// Provenance traces an app image back to its source and the builder that produced it. It is written to
+// /etc/atlantis/info/provenance.json in the image before the build script runs and, as labels, into the
+// config of the committed image, so neither has a FinishedUTC; the builder's own copy in the manifest dir
+// is written once the image is committed and has.
+type Provenance struct {
+	App            string `json:"app"`
+	Sha            string `json:"sha"`
+	URL            string `json:"url"`
+	RelPath        string `json:"rel_path"`
+	BuilderLayer   string `json:"builder_layer"`
+	BuilderVersion string `json:"builder_version"`
+	BuilderHost    string `json:"builder_host"`
+	BuildID        string `json:"build_id"`
+	StartedUTC     string `json:"started_utc"`
+	FinishedUTC    string `json:"finished_utc,omitempty"`
+	ManifestSha256 string `json:"manifest_sha256"`
+	Reproducible   bool   `json:"reproducible,omitempty"`
+}
+
+// Labels are the provenance fields that are set, which is all of them but those a reproducible build
+// leaves out.
+func (p *Provenance) Labels() map[string]string {
+	labels := map[string]string{
+		"app":             p.App,
+		"sha":             p.Sha,
+		"url":             p.URL,
+		"rel_path":        p.RelPath,
+		"builder_layer":   p.BuilderLayer,
+		"builder_version": p.BuilderVersion,
+		"builder_host":    p.BuilderHost,
+		"build_id":        p.BuildID,
+		"started_utc":     p.StartedUTC,
+		"manifest_sha256": p.ManifestSha256,
+		"reproducible":    fmt.Sprint(p.Reproducible),
+	}
+	for key, val := range labels {
+		if val == "" {
+			delete(labels, key)
+		}
+	}
+	return labels
+}
+
+func fileSha256(fname string) string {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeProvenance writes provenance.json to dir and, if there is a ProvenanceKey, provenance.sig holding
+// its RSA PKCS#1 v1.5 SHA-256 signature, which can be checked with openssl dgst -sha256 -verify.
+func writeProvenance(infoDir string, prov *Provenance) {
+	if err := os.MkdirAll(infoDir, 0755); err != nil {
+		panic(err)
+	}
+
+	data, err := json.MarshalIndent(prov, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path.Join(infoDir, "provenance.json"), data, 0644); err != nil {
+		panic(err)
+	}
+
+	if ProvenanceKey == nil {
+		return
+	}
+	digest := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ProvenanceKey, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path.Join(infoDir, "provenance.sig"), sig, 0644); err != nil {
+		panic(err)
+	}
+}
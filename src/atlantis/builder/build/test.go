@@ -0,0 +1,156 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package build
+
+import (
+	"atlantis/builder/docker"
+	"atlantis/builder/manifest"
+	"atlantis/builder/template"
+	"atlantis/builder/util"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TestResults is written to tests/results.json in the build's manifest dir, next to the test output and the
+// result files the manifest asked for.
+type TestResults struct {
+	ExitCode int      `json:"exit_code"`
+	Passed   bool     `json:"passed"`
+	Error    string   `json:"error,omitempty"`
+	Files    []string `json:"files"`
+}
+
+// maxTestResultSize is the most of a single result file that's kept.
+const maxTestResultSize = 16 << 20
+
+// copyTestResults copies the regular files the tests left in fromDir to toDir. The tests' container wrote
+// them, so anything else (a symlink to the builder's own files, say) is skipped rather than followed, as are
+// files over maxTestResultSize.
+func copyTestResults(fromDir, toDir string) []string {
+	files := []string{}
+	walk := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			fmt.Printf("Skipping test result %s: not a regular file\n", path)
+			return nil
+		}
+		if info.Size() > maxTestResultSize {
+			fmt.Printf("Skipping test result %s: %d bytes is over %d\n", path, info.Size(), maxTestResultSize)
+			return nil
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(path, fromDir), "/")
+		target := filepath.Join(toDir, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		data, err := util.ReadRegularFile(path, maxTestResultSize)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return ioutil.WriteFile(target, data, 0644)
+	}
+	if err := filepath.Walk(fromDir, walk); err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+	return files
+}
+
+// runTests runs the manifest's test commands against a copy of the app's source in a throwaway container
+// from the builder layer, so nothing the tests leave behind ends up in the app image. They're constrained
+// by the same opts as the build.
+func runTests(client *docker.Client, builderLayer, sourceDir, manifestDir string, manifest *manifest.Data, opts docker.ContainerOptions) {
+	testDir, err := ioutil.TempDir("", manifest.Name+"-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	copyApp(testDir, sourceDir)
+	template.WriteSetupScript(path.Join(testDir, "setup"), manifest)
+	template.WriteTestScript(path.Join(testDir, "run_tests"), manifest.Name, manifest.TestCommands, manifest.TestResults)
+
+	fmt.Printf("Running tests: %v\n", manifest.TestCommands)
+	tout := time.Duration(manifest.TestTimeout) * time.Second
+	// the results are kept even when the tests time out, they're how to find out where they got stuck
+	ec, output, runErr := client.Run(builderLayer, testDir, "/overlay", opts, tout, "/overlay/run_tests")
+
+	resultsDir := path.Join(manifestDir, "tests")
+	if err := os.MkdirAll(resultsDir, 0755); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path.Join(resultsDir, "output.log"), []byte(output), 0644); err != nil {
+		panic(err)
+	}
+	results := TestResults{
+		ExitCode: ec,
+		Passed:   ec == 0 && runErr == nil,
+		Files:    append([]string{"output.log"}, copyTestResults(path.Join(testDir, "results"), resultsDir)...),
+	}
+	if runErr != nil {
+		results.Error = runErr.Error()
+	}
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path.Join(resultsDir, "results.json"), data, 0644); err != nil {
+		panic(err)
+	}
+
+	if runErr != nil {
+		panic(fmt.Sprintf("tests failed: %s\n%s", runErr, output))
+	} else if ec != 0 {
+		panic(fmt.Sprintf("tests failed: %d\n%s", ec, output))
+	}
+}
+
+// smokeTest starts the committed app image and checks that it comes up, when the manifest's smoke_test is
+// enabled. An image that fails is removed so that the next build of this sha doesn't mistake it for a
+// finished one, and the build fails with whatever the smoke test wrote, even when it timed out. Like the
+// tests, it's constrained by the same opts as the build.
+func smokeTest(client *docker.Client, appDockerName string, manifest *manifest.Data, opts docker.ContainerOptions) {
+	smokeDir, err := ioutil.TempDir("", manifest.Name+"-smoke")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(smokeDir)
+	template.WriteSmokeTestScript(path.Join(smokeDir, "smoke_test"), manifest.Name, manifest.SmokeTest)
+
+	passed := false
+	defer func() {
+		if !passed {
+			client.RemoveImage(appDockerName)
+		}
+	}()
+
+	fmt.Printf("Smoke testing: %v\n", appDockerName)
+	tout := time.Duration(manifest.SmokeTest.Timeout)*time.Second + time.Minute
+	ec, output, err := client.Run(appDockerName, smokeDir, "/smoke", opts, tout, "/smoke/smoke_test")
+	if err != nil {
+		panic(fmt.Sprintf("smoke test failed: %s\n%s", err, output))
+	} else if ec != 0 {
+		panic(fmt.Sprintf("smoke test failed: %d\n%s", ec, output))
+	}
+	passed = true
+}
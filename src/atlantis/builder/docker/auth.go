@@ -0,0 +1,140 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"strings"
+)
+
+// RegistryAuth is how to log in to Registry: with Username and Password, with Username and an access Token
+// in place of the password, or with the credentials for Registry in the docker config.json DockerConfig.
+type RegistryAuth struct {
+	Registry     string `toml:"registry"`
+	Username     string `toml:"username"`
+	Password     string `toml:"password"`
+	Token        string `toml:"token"`
+	DockerConfig string `toml:"docker_config"`
+}
+
+var registryAuths = map[string]docker.AuthConfiguration{}
+
+// secrets are redacted from anything about pulls and pushes that's printed or returned.
+var secrets = []string{}
+
+// registryHost drops the scheme and path of a registry, so https://index.docker.io/v1/ and index.docker.io
+// are the same registry.
+func registryHost(registry string) string {
+	if i := strings.Index(registry, "://"); i >= 0 {
+		registry = registry[i+3:]
+	}
+	return strings.SplitN(registry, "/", 2)[0]
+}
+
+// SetRegistryAuths replaces the credentials used to pull from and push to registries. Registries without
+// any are used anonymously.
+func SetRegistryAuths(auths []RegistryAuth) error {
+	resolved := map[string]docker.AuthConfiguration{}
+	for _, auth := range auths {
+		if auth.Registry == "" {
+			return errors.New("registry auth without a registry")
+		}
+		conf := docker.AuthConfiguration{Username: auth.Username, ServerAddress: auth.Registry}
+		switch {
+		case auth.DockerConfig != "":
+			var err error
+			if conf, err = readDockerConfig(auth.DockerConfig, auth.Registry); err != nil {
+				return err
+			}
+		case auth.Token != "":
+			conf.Password = auth.Token
+		default:
+			conf.Password = auth.Password
+		}
+		if conf.Username == "" || conf.Password == "" {
+			return fmt.Errorf("registry auth for %s needs a username and a password or token", auth.Registry)
+		}
+		resolved[registryHost(auth.Registry)] = conf
+	}
+
+	registryAuths = resolved
+	secrets = []string{}
+	for _, conf := range resolved {
+		basic := base64.StdEncoding.EncodeToString([]byte(conf.Username + ":" + conf.Password))
+		secrets = append(secrets, conf.Password, basic)
+	}
+	return nil
+}
+
+// readDockerConfig finds the credentials for registry in a docker config.json, as written by docker login
+// without a credential store, including the identity tokens of registries that log in with OAuth.
+func readDockerConfig(fname, registry string) (docker.AuthConfiguration, error) {
+	conf := docker.AuthConfiguration{ServerAddress: registry}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return conf, err
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth          string `json:"auth"`
+			Username      string `json:"username"`
+			Password      string `json:"password"`
+			IdentityToken string `json:"identitytoken"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return conf, errors.New(fname + ": " + err.Error())
+	}
+	for server, entry := range config.Auths {
+		if registryHost(server) != registryHost(registry) {
+			continue
+		}
+		conf.Username, conf.Password = entry.Username, entry.Password
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return conf, fmt.Errorf("%s: bad auth for %s", fname, server)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return conf, fmt.Errorf("%s: bad auth for %s", fname, server)
+			}
+			conf.Username, conf.Password = parts[0], parts[1]
+		}
+		if entry.IdentityToken != "" {
+			// the docker API this builder speaks has no identity tokens, registries that hand them out
+			// take them as the password of the login they came with
+			conf.Password = entry.IdentityToken
+		}
+		return conf, nil
+	}
+	return conf, fmt.Errorf("%s has no credentials for %s", fname, registry)
+}
+
+func authFor(registry string) docker.AuthConfiguration {
+	return registryAuths[registryHost(registry)]
+}
+
+// redact blanks out any registry password or token in s.
+func redact(s string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.Replace(s, secret, "[REDACTED]", -1)
+		}
+	}
+	return s
+}
@@ -12,91 +12,227 @@
 package docker
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/fsouza/go-dockerclient"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 var LogOutput bool
 
+// Client builds images for the registry at URL. Mirrors are other registries app images are pushed to as
+// well and builder layers are pulled from when URL doesn't have them.
 type Client struct {
-	URL    string
-	client *docker.Client
+	URL     string
+	Mirrors []string
+	client  *docker.Client
 }
 
-func New(url string) *Client {
-	dockerClient, err := docker.NewClient("unix:///var/run/docker.sock")
+func New(url string, mirrors ...string) *Client {
+	dockerClient, err := docker.NewClient("unix://" + DaemonSocket)
 	if err != nil {
 		panic(err)
 	}
-	return &Client{URL: url, client: dockerClient}
+	return &Client{URL: url, Mirrors: mirrors, client: dockerClient}
 }
 
-func (c *Client) PullImage(repository string) bool {
-	pullOpts := docker.PullImageOptions{
-		Repository:   c.URL + "/" + repository,
-		Registry:     c.URL,
-		OutputStream: os.Stdout,
+// name is the full name of repository, which is just repository when there's no registry. Images without a
+// registry can't be pulled or pushed, only built and saved.
+func (c *Client) name(repository string) string {
+	if c.URL == "" {
+		return repository
 	}
+	return c.URL + "/" + repository
+}
 
-	// If PullImage succeeds, image exists and
-	// we return true.
-	return c.client.PullImage(pullOpts, docker.AuthConfiguration{}) == nil
+// PullImage pulls repository from the first registry that has it. An image from a mirror is tagged as if it
+// came from URL, which is the name everything else uses. When no registry has it, the error says why each
+// pull failed, with the registry credentials redacted.
+func (c *Client) PullImage(repository string) error {
+	failures := []string{}
+	for _, registry := range append([]string{c.URL}, c.Mirrors...) {
+		if registry == "" {
+			continue
+		}
+		pullOpts := docker.PullImageOptions{
+			Repository:   registry + "/" + repository,
+			Registry:     registry,
+			OutputStream: os.Stdout,
+		}
+		pull := func() error { return c.client.PullImage(pullOpts, authFor(registry)) }
+		if _, err := Retry.do("pull "+pullOpts.Repository, pull); err != nil {
+			failures = append(failures, fmt.Sprintf("pull from %s failed: %s", registry, err))
+			continue
+		}
+		if registry != c.URL {
+			if err := tagImage(registry+"/"+repository, c.name(repository)); err != nil {
+				panic(err)
+			}
+		}
+		return nil
+	}
+	if len(failures) == 0 {
+		return errors.New("no registry to pull " + repository + " from")
+	}
+	return errors.New(strings.Join(failures, "; "))
 }
 
-func (c *Client) PushImage(repository string, stream bool) {
+// push pushes the image to registry, which gets its own tag for the push if it's a mirror. A failed push
+// is retried as Retry says, and the number of attempts it took returned. Errors have the registry
+// credentials redacted.
+func (c *Client) push(registry, repository string, out io.Writer) (int, error) {
+	name := registry + "/" + repository
+	if registry != c.URL {
+		if err := tagImage(c.name(repository), name); err != nil {
+			return 0, err
+		}
+		// the mirror's tag is the full name, like URL's; removing it only drops the tag, the image stays
+		defer c.client.RemoveImage(name)
+	}
 	pushOpts := docker.PushImageOptions{
-		Name:         c.URL + "/" + repository,
-		Registry:     c.URL,
-		OutputStream: ioutil.Discard,
+		Name:         name,
+		Registry:     registry,
+		OutputStream: out,
 	}
+
+	authConf := authFor(registry)
+
+	return Retry.do("push "+name, func() error { return c.client.PushImage(pushOpts, authConf) })
+}
+
+// PushImage pushes repository to URL only.
+func (c *Client) PushImage(repository string, stream bool) {
+	out := ioutil.Discard
 	if stream {
-		pushOpts.OutputStream = os.Stdout
+		out = os.Stdout
+	}
+	if _, err := c.push(c.URL, repository, out); err != nil {
+		defer c.RemoveImage(repository)
+		panic(err)
 	}
+}
 
-	authConf := docker.AuthConfiguration{}
+// PushResult is how pushing an image to one registry went, and how many attempts it took.
+type PushResult struct {
+	Registry string
+	Attempts int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
 
-	if err := c.client.PushImage(pushOpts, authConf); err != nil {
-		fmt.Fprintf(os.Stderr, "PushImage error: %s\n", err.Error())
-		time.Sleep(time.Duration(30) * time.Second)
-		if err = c.client.PushImage(pushOpts, authConf); err != nil {
-			defer c.client.RemoveImage(repository)
-			panic(err)
+// PushImageToAll pushes repository to URL and all the Mirrors in parallel, and returns how each push went,
+// URL's first. Only a failed push to URL panics.
+func (c *Client) PushImageToAll(repository string, stream bool) []PushResult {
+	registries := append([]string{c.URL}, c.Mirrors...)
+	results := make([]PushResult, len(registries))
+	var wg sync.WaitGroup
+	for i, registry := range registries {
+		wg.Add(1)
+		go func(i int, registry string) {
+			defer wg.Done()
+			// only URL's progress is streamed, the mirrors' would be interleaved with it
+			out := ioutil.Discard
+			if stream && i == 0 {
+				out = os.Stdout
+			}
+			results[i].Registry = registry
+			attempts, err := c.push(registry, repository, out)
+			results[i].Attempts = attempts
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, registry)
+	}
+	wg.Wait()
+
+	for _, result := range results[1:] {
+		if result.Error != "" {
+			fmt.Fprintf(os.Stderr, "Push to mirror %s failed: %s\n", result.Registry, result.Error)
 		}
 	}
+	if results[0].Error != "" {
+		defer c.RemoveImage(repository)
+		panic(fmt.Sprintf("push to %s failed: %s", c.URL, results[0].Error))
+	}
+	return results
+}
+
+// Image is an image as built, with the size of its own layer.
+type Image struct {
+	ID   string
+	Size int64
+}
+
+// inspectImage runs inspect on the image name as Retry says. That it doesn't exist is an answer, and
+// returned as docker.ErrNoSuchImage right away.
+func inspectImage(name string, inspect func(name string) (*docker.Image, error)) (*docker.Image, error) {
+	var image *docker.Image
+	_, err := Retry.do("inspect "+name, func() error {
+		var err error
+		image, err = inspect(name)
+		return err
+	})
+	return image, err
+}
+
+// inspect asks the local daemon about the image name.
+func (c *Client) inspect(name string) Image {
+	image, err := inspectImage(name, c.client.InspectImage)
+	if err != nil {
+		panic(fmt.Sprintf("inspect of %s failed: %s", name, err))
+	}
+	return Image{ID: image.ID, Size: image.Size}
 }
 
-func (c *Client) ImageExists(repository string) bool {
-	imageName := c.URL + "/" + repository
+// InspectImage returns the id and size of the image of repository, which has to exist.
+func (c *Client) InspectImage(repository string) Image {
+	return c.inspect(c.name(repository))
+}
 
-	_, err := c.client.InspectImage(imageName)
+// ImageExists says whether the daemon has the image of repository, pulling it if it doesn't. When it
+// doesn't exist, the error is why it couldn't be pulled.
+func (c *Client) ImageExists(repository string) (bool, error) {
+	_, err := inspectImage(c.name(repository), c.client.InspectImage)
 	switch err {
 	case docker.ErrNoSuchImage:
-		return c.PullImage(repository)
+		if err := c.PullImage(repository); err != nil {
+			return false, err
+		}
+		return true, nil
 	case nil:
-		return true
+		return true, nil
 	}
 
 	panic(err)
 }
 
-func (c *Client) OverlayAndCommit(imageFrom, imageTo, bindFrom, bindTo string, tout time.Duration, runScript ...string) {
+// OverlayAndCommit runs runScript in a container from imageFrom, with bindFrom mounted at bindTo and
+// constrained by opts, and commits the result as imageTo with labels.
+func (c *Client) OverlayAndCommit(imageFrom, imageTo, bindFrom, bindTo string, labels map[string]string, opts ContainerOptions, tout time.Duration, runScript ...string) Image {
 	containerConfig := &docker.Config{
 		Cmd:   runScript,
-		Image: c.URL + "/" + imageFrom,
+		Image: c.name(imageFrom),
 		Volumes: map[string]struct{}{
 			bindTo: struct{}{},
 		},
 	}
 	hostConfig := &docker.HostConfig{
-		Privileged: true,
 		Binds: []string{
 			fmt.Sprintf("%s:%s", bindFrom, bindTo),
 		},
 	}
+	gateDir, err := opts.configure(containerConfig, hostConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer os.RemoveAll(gateDir)
 
 	uniqName := fmt.Sprintf("%s-%d", path.Base(imageTo), time.Now().Unix())
 	container, err := c.client.CreateContainer(docker.CreateContainerOptions{Name: uniqName, Config: containerConfig})
@@ -116,6 +252,10 @@ func (c *Client) OverlayAndCommit(imageFrom, imageTo, bindFrom, bindTo string, t
 	if err = c.client.StartContainer(container.ID, hostConfig); err != nil {
 		panic(err)
 	}
+	if err = c.constrain(container.ID, opts, gateDir); err != nil {
+		c.client.KillContainer(docker.KillContainerOptions{ID: container.ID})
+		panic(err.Error())
+	}
 
 	if LogOutput {
 		attachOptions := docker.AttachToContainerOptions{
@@ -130,33 +270,140 @@ func (c *Client) OverlayAndCommit(imageFrom, imageTo, bindFrom, bindTo string, t
 		}
 	}
 
-	result := make(chan int)
-	go func() {
-		for {
-			inspect, err := c.client.InspectContainer(container.ID)
-			if err != nil {
-				panic(err)
-			}
+	ec, err := c.wait(container.ID, tout)
+	if err != nil {
+		panic(err.Error())
+	} else if ec != 0 {
+		panic(fmt.Sprintf("run script failed: %d", ec))
+	}
 
-			if !inspect.State.Running {
-				result <- inspect.State.ExitCode
-				return
-			}
-			time.Sleep(time.Second)
-		}
+	committed, err := c.client.CommitContainer(c.commitOptions(container.ID, imageFrom, imageTo, labels))
+	if err != nil {
+		panic(fmt.Sprintf("commit of %s failed: %s", imageTo, err))
+	} else if committed == nil || committed.ID == "" {
+		panic(fmt.Sprintf("commit of %s failed: no image id", imageTo))
+	}
+	// the commit only answers with the id
+	image := c.inspect(committed.ID)
+	fmt.Printf("Committed %s: %s (%d bytes)\n", imageTo, image.ID, image.Size)
+	return image
+}
+
+// commitOptions commit the container as imageTo. The docker API this builder speaks has no image labels,
+// so each label is added to the image's environment as ATLANTIS_<KEY> instead, sorted so the config is the
+// same for the same labels. That's how docker inspect can tell where an image came from.
+func (c *Client) commitOptions(id, imageFrom, imageTo string, labels map[string]string) docker.CommitContainerOptions {
+	// NOTE(jigish) Should we pass the bind mount and port configuration here during the build?
+	env := []string{}
+	for key, val := range labels {
+		env = append(env, fmt.Sprintf("ATLANTIS_%s=%s", strings.ToUpper(key), val))
+	}
+	sort.Strings(env)
+	return docker.CommitContainerOptions{
+		Container:  id,
+		Repository: c.name(imageTo),
+		Author:     "atlantis-builder",
+		Message:    fmt.Sprintf("built from %s", imageFrom),
+		Run:        &docker.Config{Env: env},
+	}
+}
+
+// killTimeout is how long wait gives a killed container to exit.
+var killTimeout = 30 * time.Second
+
+// wait blocks until the container exits and returns its exit code, killing it if it runs longer than tout.
+func (c *Client) wait(id string, tout time.Duration) (int, error) {
+	type exit struct {
+		code int
+		err  error
+	}
+	// buffered, so the waiting goroutine can hand over its result and be done even after a timeout
+	result := make(chan exit, 1)
+	go func() {
+		code, err := c.client.WaitContainer(id)
+		result <- exit{code, err}
 	}()
 
+	timer := time.NewTimer(tout)
+	defer timer.Stop()
 	select {
-	case ec := <-result:
-		if ec != 0 {
-			panic(fmt.Sprintf("run script failed: %d", ec))
+	case e := <-result:
+		return e.code, e.err
+	case <-timer.C:
+		if err := c.client.KillContainer(docker.KillContainerOptions{ID: id}); err != nil {
+			return -1, fmt.Errorf("run script timed out in %s and could not be killed: %s", tout, err)
+		}
+		// the kill ends the WaitContainer, unless the daemon never gets around to it
+		killTimer := time.NewTimer(killTimeout)
+		defer killTimer.Stop()
+		select {
+		case <-result:
+			return -1, fmt.Errorf("run script timed out in %s", tout)
+		case <-killTimer.C:
+			return -1, fmt.Errorf("run script timed out in %s and did not exit within %s of being killed", tout, killTimeout)
 		}
-	case <-time.After(tout):
+	}
+}
+
+// Run starts a throwaway container from image, constrained by opts, and waits for it to finish. It returns
+// the exit code of runScript together with everything the container wrote to stdout and stderr. A
+// container that runs longer than tout is killed, and what it wrote until then is returned along with the
+// timeout as the error.
+func (c *Client) Run(image, bindFrom, bindTo string, opts ContainerOptions, tout time.Duration, runScript ...string) (int, string, error) {
+	containerConfig := &docker.Config{
+		Cmd:   runScript,
+		Image: c.name(image),
+		Volumes: map[string]struct{}{
+			bindTo: struct{}{},
+		},
+	}
+	hostConfig := &docker.HostConfig{
+		Binds: []string{
+			fmt.Sprintf("%s:%s", bindFrom, bindTo),
+		},
+	}
+	gateDir, err := opts.configure(containerConfig, hostConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer os.RemoveAll(gateDir)
+
+	uniqName := fmt.Sprintf("%s-run-%d", path.Base(image), time.Now().Unix())
+	container, err := c.client.CreateContainer(docker.CreateContainerOptions{Name: uniqName, Config: containerConfig})
+	if err != nil {
+		panic(err)
+	}
+	defer c.client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+
+	if err = c.client.StartContainer(container.ID, hostConfig); err != nil {
+		panic(err)
+	}
+	if err = c.constrain(container.ID, opts, gateDir); err != nil {
 		c.client.KillContainer(docker.KillContainerOptions{ID: container.ID})
-		panic(fmt.Sprintf("run script timed out in %s", tout))
+		panic(err.Error())
 	}
 
-	// NOTE(jigish) Should we pass the bind mount and port configuration here during the build?
-	opts := docker.CommitContainerOptions{Container: container.ID, Repository: c.URL + "/" + imageTo, Run: &docker.Config{}}
-	c.client.CommitContainer(opts)
+	var output bytes.Buffer
+	ec, waitErr := c.wait(container.ID, tout)
+
+	// the container has exited or been killed by now, so attaching with Logs replays everything it wrote
+	attachOptions := docker.AttachToContainerOptions{
+		Container:    container.ID,
+		OutputStream: &output,
+		ErrorStream:  &output,
+		Logs:         true,
+		Stdout:       true,
+		Stderr:       true,
+	}
+	if err = c.client.AttachToContainer(attachOptions); err != nil {
+		panic(err)
+	}
+	if LogOutput {
+		os.Stdout.Write(output.Bytes())
+	}
+	return ec, output.String(), waitErr
+}
+
+func (c *Client) RemoveImage(repository string) error {
+	return c.client.RemoveImage(c.name(repository))
 }
@@ -0,0 +1,73 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"reflect"
+	"testing"
+)
+
+func TestCommitOptions(t *testing.T) {
+	c := &Client{URL: "registry.example.com"}
+	labels := map[string]string{"sha": "0123abcd", "app": "hello", "builder_layer": "builder/go"}
+	opts := c.commitOptions("abc123", "builder/go", "apps/hello-0123abcd", labels)
+	if opts.Container != "abc123" {
+		t.Errorf("committed container %q, expected abc123", opts.Container)
+	}
+	if opts.Repository != "registry.example.com/apps/hello-0123abcd" {
+		t.Errorf("committed as %q, expected registry.example.com/apps/hello-0123abcd", opts.Repository)
+	}
+	if opts.Run == nil {
+		t.Fatal("committed without a config")
+	}
+	expected := []string{"ATLANTIS_APP=hello", "ATLANTIS_BUILDER_LAYER=builder/go", "ATLANTIS_SHA=0123abcd"}
+	if !reflect.DeepEqual(opts.Run.Env, expected) {
+		t.Errorf("committed with env %v, expected %v", opts.Run.Env, expected)
+	}
+}
+
+// flakyInspect fails with each of errs in turn before finding the image.
+func flakyInspect(calls *int, errs ...error) func(name string) (*docker.Image, error) {
+	return func(name string) (*docker.Image, error) {
+		*calls++
+		if *calls <= len(errs) {
+			return nil, errs[*calls-1]
+		}
+		return &docker.Image{ID: "abc123"}, nil
+	}
+}
+
+func TestInspectImageRetries(t *testing.T) {
+	defer func(retry *RetryPolicy) { Retry = retry }(Retry)
+	Retry = &RetryPolicy{MaxAttempts: 3, InitialDelay: "1ms", MaxDelay: "1ms"}
+	if err := Retry.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	image, err := inspectImage("apps/hello", flakyInspect(&calls, &docker.Error{Status: 500, Message: "daemon busy"}))
+	if err != nil || image == nil || image.ID != "abc123" {
+		t.Errorf("inspect after a transient failure: %v, %v", image, err)
+	}
+	if calls != 2 {
+		t.Errorf("inspected %d times, expected 2", calls)
+	}
+
+	calls = 0
+	if _, err := inspectImage("apps/hello", flakyInspect(&calls, docker.ErrNoSuchImage)); err != docker.ErrNoSuchImage {
+		t.Errorf("inspect of a missing image: %v, expected %v", err, docker.ErrNoSuchImage)
+	}
+	if calls != 1 {
+		t.Errorf("inspected a missing image %d times, expected 1", calls)
+	}
+}
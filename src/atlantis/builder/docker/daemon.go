@@ -0,0 +1,79 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DaemonSocket is where the docker daemon listens.
+const DaemonSocket = "/var/run/docker.sock"
+
+// daemonClient calls the daemon's remote API directly, for what the go-dockerclient this builder is pinned
+// to can't do: tagging and saving images.
+var daemonClient = &http.Client{
+	Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", DaemonSocket)
+		},
+	},
+}
+
+// daemonRequest sends a request to the daemon and returns the response of a successful one, which the
+// caller closes. Image names go into the path as they are, the daemon's routes allow their slashes.
+func daemonRequest(method, path string, query url.Values) (*http.Response, error) {
+	reqURL := "http://docker" + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := daemonClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// tagImage tags the image name as repo:latest, moving the tag if another image has it.
+func tagImage(name, repo string) error {
+	resp, err := daemonRequest("POST", "/images/"+name+"/tag", url.Values{"repo": {repo}, "tag": {"latest"}, "force": {"1"}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// saveImage writes the image name to w as a docker save tarball.
+func saveImage(name string, w io.Writer) error {
+	resp, err := daemonRequest("GET", "/images/"+name+"/get", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,291 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"archive/tar"
+	"atlantis/builder/util"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// SaveImage writes repository to w as a docker save tarball, which docker load reads back.
+func (c *Client) SaveImage(repository string, w io.Writer) error {
+	return saveImage(c.name(repository), w)
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociLayout writes blobs into an OCI image layout directory.
+type ociLayout struct {
+	dir string
+}
+
+// writeBlob copies r into the layout's blobs, named by its sha256.
+func (l *ociLayout) writeBlob(mediaType string, r io.Reader) (ociDescriptor, error) {
+	blobDir := path.Join(l.dir, "blobs", "sha256")
+	tmp, err := ioutil.TempFile(blobDir, "blob")
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return ociDescriptor{}, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err := os.Rename(tmp.Name(), path.Join(blobDir, sum)); err != nil {
+		os.Remove(tmp.Name())
+		return ociDescriptor{}, err
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + sum, Size: size}, nil
+}
+
+func (l *ociLayout) writeFileBlob(mediaType, fname string) (ociDescriptor, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer file.Close()
+	return l.writeBlob(mediaType, file)
+}
+
+func (l *ociLayout) writeJSONBlob(mediaType string, v interface{}) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	return l.writeBlob(mediaType, strings.NewReader(string(data)))
+}
+
+// WriteOCILayout turns the docker save tarball saved into an OCI image layout at dir, with the image's
+// manifest tagged ref in the index. Tarballs from docker 25 and later already are OCI layouts and are
+// unpacked as they are; older ones, with or without a manifest.json, are converted.
+func WriteOCILayout(saved, dir, ref string) error {
+	unpacked, err := ioutil.TempDir("", "docker-save")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(unpacked)
+	if err := untar(saved, unpacked); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path.Join(unpacked, "oci-layout")); err == nil {
+		return util.CopyTree(unpacked, dir, nil)
+	}
+
+	layout := &ociLayout{dir: dir}
+	if err := os.MkdirAll(path.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	var layerFiles []string
+	if _, err := os.Stat(path.Join(unpacked, "manifest.json")); err == nil {
+		config, layerFiles, err = readSaveManifest(unpacked)
+		if err != nil {
+			return err
+		}
+	} else {
+		config, layerFiles, err = readLegacySave(unpacked)
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest := ociManifest{SchemaVersion: 2, MediaType: ociManifestType, Layers: []ociDescriptor{}}
+	diffIDs := []string{}
+	for _, layerFile := range layerFiles {
+		desc, err := layout.writeFileBlob(ociLayerType, layerFile)
+		if err != nil {
+			return err
+		}
+		// the layers are uncompressed, so their digests are the diff ids as well
+		manifest.Layers = append(manifest.Layers, desc)
+		diffIDs = append(diffIDs, desc.Digest)
+	}
+	config["rootfs"] = map[string]interface{}{"type": "layers", "diff_ids": diffIDs}
+	if manifest.Config, err = layout.writeJSONBlob(ociConfigType, config); err != nil {
+		return err
+	}
+
+	manifestDesc, err := layout.writeJSONBlob(ociManifestType, manifest)
+	if err != nil {
+		return err
+	}
+	manifestDesc.Annotations = map[string]string{"org.opencontainers.image.ref.name": ref}
+	index, err := json.Marshal(ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{manifestDesc}})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "index.json"), index, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+// readSaveManifest reads the image config and layers of a docker save tarball from docker 1.10 or later.
+func readSaveManifest(unpacked string) (map[string]interface{}, []string, error) {
+	var manifests []struct {
+		Config string
+		Layers []string
+	}
+	if err := readJSON(path.Join(unpacked, "manifest.json"), &manifests); err != nil {
+		return nil, nil, err
+	}
+	if len(manifests) != 1 {
+		return nil, nil, errors.New("expected exactly one image in the docker save tarball")
+	}
+	config := map[string]interface{}{}
+	if err := readJSON(path.Join(unpacked, manifests[0].Config), &config); err != nil {
+		return nil, nil, err
+	}
+	layerFiles := []string{}
+	for _, layer := range manifests[0].Layers {
+		layerFiles = append(layerFiles, path.Join(unpacked, layer))
+	}
+	return config, layerFiles, nil
+}
+
+// readLegacySave pieces together an image config from the per layer json of a docker save tarball from
+// before docker 1.10, where the top layer's is the image's and each names its parent.
+func readLegacySave(unpacked string) (map[string]interface{}, []string, error) {
+	repositories := map[string]map[string]string{}
+	if err := readJSON(path.Join(unpacked, "repositories"), &repositories); err != nil {
+		return nil, nil, err
+	}
+	top := ""
+	for _, tags := range repositories {
+		for _, id := range tags {
+			if top != "" && top != id {
+				return nil, nil, errors.New("expected exactly one image in the docker save tarball")
+			}
+			top = id
+		}
+	}
+	if top == "" {
+		return nil, nil, errors.New("no image in the docker save tarball")
+	}
+
+	var image map[string]interface{}
+	layerFiles := []string{}
+	for id := top; id != ""; {
+		layer := map[string]interface{}{}
+		if err := readJSON(path.Join(unpacked, id, "json"), &layer); err != nil {
+			return nil, nil, err
+		}
+		if image == nil {
+			image = layer
+		}
+		layerFiles = append([]string{path.Join(unpacked, id, "layer.tar")}, layerFiles...)
+		id, _ = layer["parent"].(string)
+	}
+
+	config := map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+	}
+	for _, key := range []string{"created", "author", "architecture", "os", "config"} {
+		if val, ok := image[key]; ok && val != nil && val != "" {
+			config[key] = val
+		}
+	}
+	return config, layerFiles, nil
+}
+
+func readJSON(fname string, v interface{}) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// untar unpacks the tarball fname into dir. It only expects what docker save writes: directories, files
+// and symlinks between layers.
+func untar(fname, dir string) error {
+	file, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
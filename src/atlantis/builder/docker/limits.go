@@ -0,0 +1,264 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ContainerOptions constrain a container started by the builder. Limits that are zero aren't applied.
+// An Isolated container can only reach the Proxies, which its HTTP_PROXY and HTTPS_PROXY point at, and the
+// name servers that resolve them, and has no network at all when there aren't any proxies. Isolated
+// containers can't be Privileged, which would let them lift their own isolation.
+type ContainerOptions struct {
+	Env        []string
+	CPUShares  int64
+	Memory     int64
+	PidsLimit  int64
+	Privileged bool
+	Isolated   bool
+	Proxies    []string
+}
+
+// gateMount is where a gated container finds out it can run its command.
+const gateMount = "/.atlantis-gate"
+
+// gateScript holds the command, its arguments, until constrain opens the gate.
+const gateScript = "while [ ! -e " + gateMount + "/open ]; do sleep 1; done; exec \"$@\""
+
+// gated says whether the container has limits that can only be applied once it's running, which the docker
+// API this builder speaks has no settings for.
+func (o ContainerOptions) gated() bool {
+	return o.PidsLimit > 0 || (o.Isolated && len(o.Proxies) > 0)
+}
+
+// configure sets up the container to be created for the options. A container with limits that can't be
+// set when it's created is gated: it waits for constrain to apply them before running its command. The
+// returned directory is the gate, which the caller removes once the container is gone.
+func (o ContainerOptions) configure(config *docker.Config, hostConfig *docker.HostConfig) (string, error) {
+	if o.Isolated && o.Privileged {
+		return "", errors.New("an isolated container can't be privileged")
+	}
+	config.Env = append(config.Env, o.Env...)
+	config.CpuShares = o.CPUShares
+	config.Memory = o.Memory
+	hostConfig.Privileged = o.Privileged
+	if o.Isolated && len(o.Proxies) == 0 {
+		config.NetworkDisabled = true
+	} else if o.Isolated {
+		for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+			config.Env = append(config.Env, name+"="+o.Proxies[0])
+		}
+		config.Env = append(config.Env, "NO_PROXY=localhost,127.0.0.1", "no_proxy=localhost,127.0.0.1")
+	}
+	if !o.gated() {
+		return "", nil
+	}
+
+	gateDir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		return "", err
+	}
+	config.Cmd = append([]string{"/bin/sh", "-c", gateScript, "gate"}, config.Cmd...)
+	if config.Volumes == nil {
+		config.Volumes = map[string]struct{}{}
+	}
+	config.Volumes[gateMount] = struct{}{}
+	hostConfig.Binds = append(hostConfig.Binds, gateDir+":"+gateMount+":ro")
+	return gateDir, nil
+}
+
+// constrain applies the limits of a gated container and then opens its gate. Until then the container
+// only runs the gate script.
+func (c *Client) constrain(id string, o ContainerOptions, gateDir string) error {
+	if gateDir == "" {
+		return nil
+	}
+	if o.PidsLimit > 0 {
+		if err := limitPids(id, o.PidsLimit); err != nil {
+			return err
+		}
+	}
+	if o.Isolated && len(o.Proxies) > 0 {
+		container, err := c.client.InspectContainer(id)
+		if err != nil {
+			return err
+		}
+		if err := isolate(id, container.State.Pid, container.ResolvConfPath, o.Proxies); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path.Join(gateDir, "open"), nil, 0644)
+}
+
+// ProxyAddress is the host:port a dependency proxy URL listens on, with the port defaulting to the
+// scheme's.
+func ProxyAddress(proxy string) (string, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", errors.New("dependency proxy " + proxy + " is not a URL")
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return u.Host, nil
+	}
+	switch u.Scheme {
+	case "http":
+		return net.JoinHostPort(strings.Trim(u.Host, "[]"), "80"), nil
+	case "https":
+		return net.JoinHostPort(strings.Trim(u.Host, "[]"), "443"), nil
+	}
+	return "", errors.New("dependency proxy " + proxy + " has no port")
+}
+
+// pidsCgroups are where docker puts a container's pids cgroup, with the cgroupfs and systemd cgroup
+// drivers, under cgroup v1 and v2.
+var pidsCgroups = []string{
+	"/sys/fs/cgroup/pids/docker/%s",
+	"/sys/fs/cgroup/pids/system.slice/docker-%s.scope",
+	"/sys/fs/cgroup/system.slice/docker-%s.scope",
+	"/sys/fs/cgroup/docker/%s",
+}
+
+// limitPids caps the number of processes in the container through its cgroup.
+func limitPids(id string, max int64) error {
+	for _, cgroup := range pidsCgroups {
+		fname := fmt.Sprintf(cgroup, id) + "/pids.max"
+		if _, err := os.Stat(fname); err != nil {
+			continue
+		}
+		return ioutil.WriteFile(fname, []byte(strconv.FormatInt(max, 10)), 0644)
+	}
+	return errors.New("no pids cgroup found for container " + id)
+}
+
+// nameServers are the name servers in a resolv.conf.
+func nameServers(resolvConf string) ([]net.IP, error) {
+	data, err := ioutil.ReadFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	servers := []net.IP{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				servers = append(servers, ip)
+			}
+		}
+	}
+	return servers, nil
+}
+
+// isolationRules are the rules that only let a container reach the name servers and the proxies. They're
+// appended to the OUTPUT chain of its own network namespace, so they go away with it.
+func isolationRules(servers []net.IP, proxies []string) (v4, v6 [][]string, err error) {
+	allow := func(ip net.IP, args ...string) {
+		rule := append([]string{"-d", ip.String()}, args...)
+		rule = append(rule, "-j", "ACCEPT")
+		if ip.To4() != nil {
+			v4 = append(v4, rule)
+		} else {
+			v6 = append(v6, rule)
+		}
+	}
+	v4 = [][]string{{"-o", "lo", "-j", "ACCEPT"}}
+	v6 = [][]string{{"-o", "lo", "-j", "ACCEPT"}}
+	for _, server := range servers {
+		allow(server, "-p", "udp", "--dport", "53")
+		allow(server, "-p", "tcp", "--dport", "53")
+	}
+	for _, proxy := range proxies {
+		hostPort, err := ProxyAddress(proxy)
+		if err != nil {
+			return nil, nil, err
+		}
+		host, port, _ := net.SplitHostPort(hostPort)
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ip := range ips {
+			allow(ip, "-p", "tcp", "--dport", port)
+		}
+	}
+	v4 = append(v4, []string{"-j", "REJECT"})
+	v6 = append(v6, []string{"-j", "REJECT"})
+	return v4, v6, nil
+}
+
+// isolate firewalls the container whose init is pid off from everything but the proxies and the name
+// servers in its resolv.conf, over IPv4 and, when it has any IPv6 addresses, IPv6. The rules are in the
+// container's network namespace, which it can't change without NET_ADMIN.
+func isolate(id string, pid int, resolvConf string, proxies []string) error {
+	servers, err := nameServers(resolvConf)
+	if err != nil {
+		return err
+	}
+	v4, v6, err := isolationRules(servers, proxies)
+	if err != nil {
+		return err
+	}
+
+	// ip netns exec finds namespaces by name in /var/run/netns
+	if err := os.MkdirAll("/var/run/netns", 0755); err != nil {
+		return err
+	}
+	netns := "atlantis-" + id
+	if len(netns) > 24 {
+		netns = netns[:24]
+	}
+	link := path.Join("/var/run/netns", netns)
+	os.Remove(link)
+	if err := os.Symlink(fmt.Sprintf("/proc/%d/ns/net", pid), link); err != nil {
+		return err
+	}
+	defer os.Remove(link)
+
+	for _, rule := range v4 {
+		if err := netnsExec(netns, "iptables", rule); err != nil {
+			return err
+		}
+	}
+	// without IPv6 addresses there's nothing to firewall, and maybe no ip6tables to do it with
+	inet6, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/net/if_inet6", pid))
+	if len(strings.TrimSpace(string(inet6))) == 0 {
+		return nil
+	}
+	for _, rule := range v6 {
+		if err := netnsExec(netns, "ip6tables", rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func netnsExec(netns, iptables string, rule []string) error {
+	args := append([]string{"netns", "exec", netns, iptables, "-A", "OUTPUT"}, rule...)
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
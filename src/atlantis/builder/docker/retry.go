@@ -0,0 +1,150 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy says how often pushes, pulls and inspects are tried. The delay before the nth retry is InitialDelay
+// times Multiplier to the n-1, at most MaxDelay, give or take a random Jitter fraction of it so builders
+// that failed together don't all retry together.
+type RetryPolicy struct {
+	MaxAttempts  int     `toml:"max_attempts"`
+	InitialDelay string  `toml:"initial_delay"`
+	MaxDelay     string  `toml:"max_delay"`
+	Multiplier   float64 `toml:"multiplier"`
+	Jitter       float64 `toml:"jitter"`
+
+	initialDelay time.Duration
+	maxDelay     time.Duration
+}
+
+// DefaultRetryPolicy tries twice, about 30 seconds apart.
+func DefaultRetryPolicy() *RetryPolicy {
+	p := &RetryPolicy{Jitter: 0.2}
+	p.Validate()
+	return p
+}
+
+// Retry is used for every push, pull and inspect.
+var Retry = DefaultRetryPolicy()
+
+// Validate fills in the defaults for what isn't set, other than Jitter, and checks the rest is sane.
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = 2
+	}
+	if p.InitialDelay == "" {
+		p.InitialDelay = "30s"
+	}
+	if p.MaxDelay == "" {
+		p.MaxDelay = "5m"
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = 2
+	}
+	if p.MaxAttempts < 1 || p.MaxAttempts > 20 {
+		return errors.New("retry max_attempts must be between 1 and 20")
+	}
+	if p.Multiplier < 1 {
+		return errors.New("retry multiplier must be at least 1")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("retry jitter must be between 0 and 1")
+	}
+	var err error
+	if p.initialDelay, err = time.ParseDuration(p.InitialDelay); err != nil {
+		return errors.New("retry initial_delay: " + err.Error())
+	}
+	if p.maxDelay, err = time.ParseDuration(p.MaxDelay); err != nil {
+		return errors.New("retry max_delay: " + err.Error())
+	}
+	if p.initialDelay < 0 || p.maxDelay < p.initialDelay {
+		return errors.New("retry max_delay must be at least initial_delay")
+	}
+	return nil
+}
+
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var jitterLock sync.Mutex
+
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	delay := float64(p.initialDelay)
+	for i := 1; i < retry; i++ {
+		delay *= p.Multiplier
+	}
+	if delay > float64(p.maxDelay) {
+		delay = float64(p.maxDelay)
+	}
+	jitterLock.Lock()
+	delay *= 1 + p.Jitter*(2*jitterRand.Float64()-1)
+	jitterLock.Unlock()
+	return time.Duration(delay)
+}
+
+// retryable says whether err could go away by trying again. Missing images and being refused by the
+// registry won't; server errors, timeouts and dropped connections might.
+func retryable(err error) bool {
+	if err == docker.ErrNoSuchImage {
+		return false
+	}
+	if apiErr, ok := err.(*docker.Error); ok {
+		return apiErr.Status >= 500 || apiErr.Status == 408 || apiErr.Status == 429
+	}
+	msg := strings.ToLower(err.Error())
+	for _, permanent := range []string{"unauthorized", "authentication required", "denied", "not found", "no such"} {
+		if strings.Contains(msg, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// do runs op until it succeeds, fails in a way that isn't retryable, or has been tried MaxAttempts times,
+// logging every failed attempt as what. It returns the number of attempts and op's last error, with any
+// credentials redacted.
+func (p *RetryPolicy) do(what string, op func() error) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			if attempt > 1 {
+				fmt.Printf("%s: succeeded on attempt %d/%d\n", what, attempt, p.MaxAttempts)
+			}
+			return attempt, nil
+		} else if err == docker.ErrNoSuchImage {
+			// an answer rather than a failure
+			return attempt, err
+		}
+		retry := retryable(err)
+		if msg := redact(err.Error()); msg != err.Error() {
+			err = errors.New(msg)
+		}
+		if !retry {
+			fmt.Printf("%s: attempt %d/%d failed, not retrying: %s\n", what, attempt, p.MaxAttempts, err)
+			return attempt, err
+		}
+		if attempt >= p.MaxAttempts {
+			fmt.Printf("%s: attempt %d/%d failed, giving up: %s\n", what, attempt, p.MaxAttempts, err)
+			return attempt, err
+		}
+		delay := p.delay(attempt)
+		fmt.Printf("%s: attempt %d/%d failed, retrying in %s: %s\n", what, attempt, p.MaxAttempts, delay, err)
+		time.Sleep(delay)
+	}
+}
@@ -13,17 +13,42 @@ package git
 
 import (
 	"atlantis/builder/util"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Info struct {
-	Commit  string   `json:"commit"`
-	Sha     string   `json:"sha"`
-	RevList []string `json:"rev_list"`
+	Commit         string            `json:"commit"`
+	Sha            string            `json:"sha"`
+	Author         string            `json:"author"`
+	AuthorEmail    string            `json:"author_email"`
+	Committer      string            `json:"committer"`
+	CommitterEmail string            `json:"committer_email"`
+	Date           string            `json:"date"`
+	Subject        string            `json:"subject"`
+	Refs           []string          `json:"refs"`
+	Submodules     map[string]string `json:"submodules"`
+	RevList        []string          `json:"rev_list"`
+	Sparse         []string          `json:"sparse,omitempty"`
+	Shallow        bool              `json:"shallow,omitempty"`
+	LFS            bool              `json:"lfs,omitempty"`
+	Signature      *Verification     `json:"signature,omitempty"`
 }
 
+var fullShaRegex = regexp.MustCompile("^[0-9a-f]{40}$")
+var shortShaRegex = regexp.MustCompile("^[0-9a-f]{7,39}$")
+
+// RevListLimit bounds the number of ancestors of the built sha recorded in Info.RevList.
+var RevListLimit = 100
+
 func checkShaExists(sha string) bool {
 	cmd := exec.Command("git", "rev-list", "--all")
 	out := util.EchoExec(cmd)
@@ -36,31 +61,137 @@ func checkShaExists(sha string) bool {
 	return false
 }
 
-func fancyCheckout(url string, sha string) {
-	cmd := exec.Command("git", "init")
+// CheckoutOptions limit how much of the repository is fetched and checked out. SparsePaths are relative to
+// the root of the repository; everything is checked out when there are none. Shallow fetches only the sha
+// itself from remotes that allow it, which leaves Info.RevList with just the sha.
+type CheckoutOptions struct {
+	SparsePaths []string
+	Shallow     bool
+}
+
+// sparsePaths cleans up paths for the sparse checkout, which is nil when one of them is the root of the
+// repository, as then there's nothing to leave out.
+func sparsePaths(paths []string) []string {
+	cleaned := []string{}
+	for _, p := range paths {
+		p = strings.TrimPrefix(path.Clean("/"+p), "/")
+		if p == "" {
+			return nil
+		}
+		cleaned = append(cleaned, p)
+	}
+	if len(cleaned) == 0 {
+		return nil
+	}
+	return cleaned
+}
+
+// setSparse restricts the working tree to paths, cleaned by sparsePaths, or lifts the restriction when
+// there are none. It has to be called before the sha is checked out.
+func setSparse(paths []string) {
+	patterns := "/*\n"
+	if len(paths) > 0 {
+		cmd := exec.Command("git", "config", "core.sparseCheckout", "true")
+		util.EchoExec(cmd)
+		patterns = ""
+		for _, p := range paths {
+			patterns += "/" + p + "/\n"
+		}
+	} else if _, err := os.Stat(".git/info/sparse-checkout"); err != nil {
+		// the checkout was never sparse
+		return
+	}
+	if err := ioutil.WriteFile(".git/info/sparse-checkout", []byte(patterns), 0644); err != nil {
+		panic(err)
+	}
+}
+
+// SparseCheckout widens the sparse checkout in dir to paths, e.g. once the manifest says what else it needs,
+// and returns the paths it's now limited to, none if one of them is the root of the repository.
+func SparseCheckout(dir string, paths []string) []string {
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	paths = sparsePaths(paths)
+	setSparse(paths)
+	cmd := exec.Command("git", "read-tree", "-mu", "HEAD")
 	util.EchoExec(cmd)
 
-	cmd = exec.Command("git", "remote", "add", "origin", url)
+	creds := mustCredentialSession()
+	defer creds.Close()
+	updateSubmodules(creds, paths)
+	return paths
+}
+
+// updateSubmodules checks out the submodules under paths, and theirs, at the shas recorded in the tree.
+func updateSubmodules(creds *credentialSession, paths []string) {
+	cmd := exec.Command("git", "submodule", "sync", "--recursive")
 	util.EchoExec(cmd)
 
-	cmd = exec.Command("git", "remote", "update")
+	args := append([]string{"submodule", "update", "--init", "--recursive", "--"}, paths...)
+	cmd = creds.command(args...)
 	util.EchoExec(cmd)
+}
 
-	if !checkShaExists(sha) {
-		panic("sha " + sha + " not found in repository!")
+// FetchLFS replaces the Git LFS pointers in the checkout in dir and its submodules with the files they
+// point at, only within paths if the checkout is sparse.
+func FetchLFS(dir string, paths []string) {
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
 	}
+	creds := mustCredentialSession()
+	defer creds.Close()
 
-	cmd = exec.Command("git", "fetch", "origin", sha)
+	cmd := exec.Command("git", "lfs", "install", "--local")
 	util.EchoExec(cmd)
 
-	cmd = exec.Command("git", "reset", "--hard", sha)
+	args := []string{"lfs", "pull"}
+	if paths = sparsePaths(paths); len(paths) > 0 {
+		args = append(args, "--include", strings.Join(paths, ","))
+	}
+	cmd = creds.command(args...)
 	util.EchoExec(cmd)
 
-	cmd = exec.Command("git", "submodule", "update", "--init")
+	cmd = creds.command("submodule", "foreach", "--recursive", "git lfs install --local && git lfs pull")
 	util.EchoExec(cmd)
 }
 
-func localCheckout(path string, sha string) {
+// shallowFetch fetches only sha, which fails on servers that don't allow fetching unadvertised objects.
+func shallowFetch(creds *credentialSession, sha string) bool {
+	cmd := creds.command("fetch", "--depth", "1", "origin", sha)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run() == nil
+}
+
+func fancyCheckout(creds *credentialSession, url string, sha string, opts CheckoutOptions) {
+	cmd := exec.Command("git", "init")
+	util.EchoExec(cmd)
+
+	cmd = exec.Command("git", "remote", "add", "origin", url)
+	util.EchoExec(cmd)
+
+	if !opts.Shallow || !shallowFetch(creds, sha) {
+		cmd = creds.command("remote", "update")
+		util.EchoExec(cmd)
+
+		if !checkShaExists(sha) {
+			panic("sha " + sha + " not found in repository!")
+		}
+
+		cmd = creds.command("fetch", "origin", sha)
+		util.EchoExec(cmd)
+	}
+
+	setSparse(opts.SparsePaths)
+
+	cmd = exec.Command("git", "reset", "--hard", sha)
+	util.EchoExec(cmd)
+
+	updateSubmodules(creds, opts.SparsePaths)
+}
+
+func localCheckout(creds *credentialSession, path string, sha string, opts CheckoutOptions) {
 	// Rsync with a trailing slash won't create a subdirectory
 	cmd := exec.Command("rsync", "-a", path+"/", ".")
 	util.EchoExec(cmd)
@@ -69,35 +200,225 @@ func localCheckout(path string, sha string) {
 		panic("sha " + sha + " not found in repository!")
 	}
 
+	setSparse(opts.SparsePaths)
+
 	cmd = exec.Command("git", "reset", "--hard", sha)
 	util.EchoExec(cmd)
+
+	if len(opts.SparsePaths) > 0 {
+		// rsync copied the whole working tree, drop what's outside the sparse paths
+		cmd = exec.Command("git", "read-tree", "-mu", "HEAD")
+		util.EchoExec(cmd)
+	}
+
+	// the rsynced submodules are wherever the local repository had them, not necessarily at sha
+	updateSubmodules(creds, opts.SparsePaths)
 }
 
-func Checkout(url, sha, path string) Info {
+func Checkout(url, sha, path string, opts CheckoutOptions) Info {
 	if err := os.Chdir(path); err != nil {
 		panic(err)
 	}
 
 	scheme := strings.SplitN(url, ":", 2)[0]
+	opts.SparsePaths = sparsePaths(opts.SparsePaths)
+
+	creds := mustCredentialSession()
+	defer creds.Close()
 
-	if scheme == "file" {
+	if MirrorDir != "" {
+		m, err := LockMirror(url)
+		if err != nil {
+			panic(err)
+		}
+		defer m.Unlock()
+		// the mirror has the whole history anyway, so there's nothing to gain from a shallow fetch
+		opts.Shallow = false
+		mirrorCheckout(creds, m, sha, opts)
+	} else if scheme == "file" {
 		path := strings.TrimPrefix(url, "file://")
-		localCheckout(path, sha)
+		opts.Shallow = false
+		localCheckout(creds, path, sha, opts)
 	} else {
-		fancyCheckout(url, sha)
+		fancyCheckout(creds, url, sha, opts)
 	}
 
 	cmd := exec.Command("git", "show-branch", "--list")
 	out := util.EchoExec(cmd)
 	commit := strings.Split(string(out), "\n")[0]
 
-	cmd = exec.Command("git", "log", "--pretty=format:%H")
-	out = util.EchoExec(cmd)
-	revlist := strings.Split(string(out), "\n")
-
-	return Info{
+	info := Info{
 		Commit:  commit,
 		Sha:     sha,
-		RevList: revlist,
+		Sparse:  opts.SparsePaths,
+		Shallow: isShallow(),
+	}
+	readCommit(&info)
+	info.Refs = refsPointingAt(creds, sha, info.Shallow)
+	info.Submodules = submoduleShas()
+
+	if Signatures != nil {
+		info.Signature = Signatures.Verify(sha, info.Refs)
+		if Signatures.Required && !info.Signature.Verified {
+			panic(fmt.Sprintf("sha %s is not signed by a trusted key, nor is any tag pointing at it:\n%s", sha, info.Signature.Output))
+		}
+	}
+
+	cmd = exec.Command("git", "rev-list", fmt.Sprintf("--max-count=%d", RevListLimit), sha)
+	out = util.EchoExec(cmd)
+	info.RevList = strings.Split(strings.TrimSpace(string(out)), "\n")
+
+	return info
+}
+
+func readCommit(info *Info) {
+	cmd := exec.Command("git", "log", "-1", "--format=%an%x00%ae%x00%cn%x00%ce%x00%ct%x00%s", info.Sha)
+	out := util.EchoExec(cmd)
+	fields := strings.Split(strings.TrimRight(string(out), "\n"), "\x00")
+	if len(fields) != 6 {
+		panic("unexpected git log output for " + info.Sha)
+	}
+	info.Author, info.AuthorEmail = fields[0], fields[1]
+	info.Committer, info.CommitterEmail = fields[2], fields[3]
+	if secs, err := strconv.ParseInt(fields[4], 10, 64); err == nil {
+		info.Date = time.Unix(secs, 0).UTC().Format(time.RFC3339)
+	}
+	info.Subject = fields[5]
+}
+
+func isShallow() bool {
+	_, err := os.Stat(".git/shallow")
+	return err == nil
+}
+
+// refsPointingAt returns the branches and tags whose commit is sha, annotated tags included. A shallow
+// clone has no refs of its own, so they're listed from origin instead.
+func refsPointingAt(creds *credentialSession, sha string, shallow bool) []string {
+	cmd := exec.Command("git", "show-ref", "--dereference")
+	if shallow {
+		cmd = creds.command("ls-remote", "origin")
+	}
+	out := util.EchoExecCanSkipError(cmd, true)
+
+	refs := []string{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != sha || !strings.HasPrefix(fields[1], "refs/") {
+			continue
+		}
+		ref := strings.TrimSuffix(fields[1], "^{}")
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// submoduleShas maps the path of every checked out submodule to its sha.
+func submoduleShas() map[string]string {
+	cmd := exec.Command("git", "submodule", "status", "--recursive")
+	out := util.EchoExec(cmd)
+
+	shas := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		// each line is <state><sha> <path> (<describe>), with state one of ' ', '-', '+' or 'U'
+		fields := strings.Fields(strings.TrimLeft(line, " -+U"))
+		if len(fields) >= 2 {
+			shas[fields[1]] = fields[0]
+		}
+	}
+	return shas
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	return (*credentialSession)(nil).output(dir, args...)
+}
+
+func (s *credentialSession) output(dir string, args ...string) (string, error) {
+	cmd := s.command(args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("git %s: %s: %s", strings.Join(args, " "), err.Error(), strings.TrimSpace(string(out))))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// CheckRef rejects a url or ref that ResolveRef won't hand to git: anything git could take for an option,
+// and refs that are neither a sha of 7 to 40 hex digits nor a valid ref name.
+func CheckRef(url, ref string) error {
+	if url == "" || strings.HasPrefix(url, "-") {
+		return errors.New("invalid url " + url)
+	}
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return errors.New("invalid ref " + ref)
+	}
+	if fullShaRegex.MatchString(ref) || shortShaRegex.MatchString(ref) {
+		return nil
+	}
+	if _, err := gitOutput("", "check-ref-format", "--allow-onelevel", ref); err != nil {
+		return errors.New("invalid ref " + ref)
+	}
+	return nil
+}
+
+// ResolveRef turns a branch, tag or (short) sha of the repository at url into the full sha of the commit it
+// points at. Branches and tags are looked up with ls-remote. A short sha needs the history, so it is only
+// resolved against an existing mirror of url, which is brought up to date if it doesn't have the sha yet.
+func ResolveRef(url, ref string) (string, error) {
+	if err := CheckRef(url, ref); err != nil {
+		return "", err
+	}
+	if fullShaRegex.MatchString(ref) {
+		return ref, nil
+	}
+
+	creds, err := newCredentialSession()
+	if err != nil {
+		return "", err
+	}
+	defer creds.Close()
+
+	out, err := creds.output("", "ls-remote", "--", url, ref, ref+"^{}")
+	if err != nil {
+		return "", err
+	}
+	candidates := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			candidates[fields[1]] = fields[0]
+		}
+	}
+	// prefer the peeled commit of an annotated tag over the tag object itself
+	for _, name := range []string{ref + "^{}", ref, "refs/heads/" + ref, "refs/tags/" + ref + "^{}", "refs/tags/" + ref} {
+		if sha, ok := candidates[name]; ok {
+			return sha, nil
+		}
+	}
+
+	if !shortShaRegex.MatchString(ref) {
+		return "", errors.New("ref " + ref + " not found in " + url)
+	}
+	if MirrorDir == "" {
+		return "", errors.New("short sha " + ref + " can't be resolved without mirrors, use the full sha")
+	}
+	m, err := LockMirror(url)
+	if err != nil {
+		return "", err
+	}
+	defer m.Unlock()
+	if !m.exists() {
+		return "", errors.New("short sha " + ref + " can't be resolved before " + url + " has been built, use the full sha")
+	}
+	sha, err := gitOutput(m.Path, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err == nil {
+		return sha, nil
+	}
+	if err := m.Update(creds); err != nil {
+		return "", err
 	}
+	return gitOutput(m.Path, "rev-parse", "--verify", ref+"^{commit}")
 }
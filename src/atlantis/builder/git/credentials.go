@@ -0,0 +1,157 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Credential lets git into the repositories on Host: over ssh with the deploy key in the file SSHKey, over
+// https with Username (x-access-token if empty) and either Token or the token in the file TokenFile.
+type Credential struct {
+	Host      string `toml:"host"`
+	SSHKey    string `toml:"ssh_key"`
+	Username  string `toml:"username"`
+	Token     string `toml:"token"`
+	TokenFile string `toml:"token_file"`
+}
+
+// Credentials are handed to every git command that talks to a remote. Only the ssh keys and tokens
+// configured here are used for their hosts; anything else falls back to the builder's own ssh config.
+var Credentials []Credential
+
+// credentialSession holds the ssh config and credential helper for one checkout in a private directory
+// outside the clone. Each checkout gets its own, so concurrent builds never see each other's files, and
+// none of it ends up in the clone, its config or the build output. The helper is handed to git with -c,
+// which git passes on to the git commands it runs itself, and ssh through GIT_SSH, so neither needs a
+// recent git.
+type credentialSession struct {
+	dir  string
+	args []string
+	env  []string
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// newCredentialSession writes out Credentials. A session without credentials has no files and nil env.
+func newCredentialSession() (*credentialSession, error) {
+	s := &credentialSession{}
+	if len(Credentials) == 0 {
+		return s, nil
+	}
+	dir, err := ioutil.TempDir("", "git-credentials")
+	if err != nil {
+		return nil, err
+	}
+	s.dir = dir
+	// nothing in here should make git wait for a password that isn't coming
+	s.env = []string{"GIT_TERMINAL_PROMPT=0"}
+
+	sshConfig := ""
+	helper := "#!/bin/sh\n[ \"$1\" = get ] || exit 0\nwhile IFS== read -r key value; do\n" +
+		"\t[ \"$key\" = host ] && host=$value\ndone\ncase \"$host\" in\n"
+	tokens := false
+	for i, cred := range Credentials {
+		if cred.Host == "" {
+			s.Close()
+			return nil, fmt.Errorf("git credential %d has no host", i)
+		}
+		if cred.SSHKey != "" {
+			sshConfig += fmt.Sprintf("Host %s\n  IdentityFile %s\n  IdentitiesOnly yes\n", cred.Host, cred.SSHKey)
+		}
+		if cred.Token == "" && cred.TokenFile == "" {
+			continue
+		}
+		tokenFile := cred.TokenFile
+		if tokenFile == "" {
+			tokenFile = path.Join(dir, fmt.Sprintf("%d.token", i))
+			if err := ioutil.WriteFile(tokenFile, []byte(cred.Token), 0600); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		username := cred.Username
+		if username == "" {
+			username = "x-access-token"
+		}
+		helper += fmt.Sprintf("%s)\n\techo username=%s\n\techo \"password=$(cat %s)\"\n\t;;\n",
+			shellQuote(cred.Host), shellQuote(username), shellQuote(tokenFile))
+		tokens = true
+	}
+	helper += "esac\n"
+
+	if sshConfig != "" {
+		// everything else still goes through the builder's own config, which ssh -F would skip. It's copied
+		// in after the keys rather than included, as Include needs OpenSSH 7.3.
+		if own, err := ioutil.ReadFile(path.Join(os.Getenv("HOME"), ".ssh/config")); err == nil {
+			sshConfig += "Host *\n" + string(own)
+		} else if !os.IsNotExist(err) {
+			s.Close()
+			return nil, err
+		}
+		configFile := path.Join(dir, "ssh_config")
+		if err := ioutil.WriteFile(configFile, []byte(sshConfig), 0600); err != nil {
+			s.Close()
+			return nil, err
+		}
+		sshFile := path.Join(dir, "ssh")
+		ssh := "#!/bin/sh\nexec ssh -o BatchMode=yes -F " + shellQuote(configFile) + " \"$@\"\n"
+		if err := ioutil.WriteFile(sshFile, []byte(ssh), 0700); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.env = append(s.env, "GIT_SSH="+sshFile)
+	}
+	if tokens {
+		helperFile := path.Join(dir, "credential-helper")
+		if err := ioutil.WriteFile(helperFile, []byte(helper), 0700); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.args = []string{"-c", "credential.helper=" + helperFile}
+	}
+	return s, nil
+}
+
+func mustCredentialSession() *credentialSession {
+	s, err := newCredentialSession()
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// command is exec.Command for git with the session's credentials.
+func (s *credentialSession) command(args ...string) *exec.Cmd {
+	if s == nil {
+		return exec.Command("git", args...)
+	}
+	cmd := exec.Command("git", append(append([]string{}, s.args...), args...)...)
+	if s.env != nil {
+		cmd.Env = append(os.Environ(), s.env...)
+	}
+	return cmd
+}
+
+// Close deletes the session's files.
+func (s *credentialSession) Close() {
+	if s != nil && s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
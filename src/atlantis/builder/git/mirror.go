@@ -0,0 +1,212 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package git
+
+import (
+	"atlantis/builder/util"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MirrorDir holds a bare mirror of every repository built, keyed by URL, so builds only fetch what's new
+// from the origin and clone the rest locally. Mirrors aren't used when it's empty.
+var MirrorDir string
+
+// ErrMirrorsDisabled is returned for mirror operations when there's no MirrorDir.
+var ErrMirrorsDisabled = errors.New("mirrors are not enabled")
+
+// Mirror is a locked mirror. Each mirror has a <key>.lock file next to its <key>.git directory, which is
+// flocked while the mirror is in use, holds the mirror's URL and whose mtime is when it was last used.
+type Mirror struct {
+	URL  string
+	Path string
+	lock *os.File
+}
+
+func mirrorKey(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+// openMirror flocks the lock file of the mirror key. Deleting a mirror removes its lock file while others
+// may be waiting on it, so a lock that was taken on a file which is no longer at the lock path is retried
+// on the one that is.
+func openMirror(key string, how int) (*Mirror, error) {
+	if err := os.MkdirAll(MirrorDir, 0755); err != nil {
+		return nil, err
+	}
+	lockPath := path.Join(MirrorDir, key+".lock")
+	for {
+		lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+			lock.Close()
+			return nil, err
+		}
+		locked, err := lock.Stat()
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(lockPath); err == nil && os.SameFile(locked, current) {
+			return &Mirror{Path: path.Join(MirrorDir, key+".git"), lock: lock}, nil
+		}
+		lock.Close()
+	}
+}
+
+// LockMirror waits for exclusive use of the mirror of url. Writing the URL to the lock file also marks the
+// mirror as used.
+func LockMirror(url string) (*Mirror, error) {
+	m, err := openMirror(mirrorKey(url), syscall.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+	m.URL = url
+	if err := m.lock.Truncate(0); err != nil {
+		m.Unlock()
+		return nil, err
+	}
+	if _, err := m.lock.WriteAt([]byte(url), 0); err != nil {
+		m.Unlock()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Mirror) Unlock() {
+	syscall.Flock(int(m.lock.Fd()), syscall.LOCK_UN)
+	m.lock.Close()
+}
+
+func (m *Mirror) exists() bool {
+	_, err := os.Stat(m.Path)
+	return err == nil
+}
+
+func (m *Mirror) hasCommit(sha string) bool {
+	_, err := gitOutput(m.Path, "cat-file", "-e", sha+"^{commit}")
+	return err == nil
+}
+
+// Update clones the mirror if it doesn't exist yet and fetches from the origin otherwise.
+func (m *Mirror) Update(creds *credentialSession) error {
+	if !m.exists() {
+		if _, err := creds.output("", "clone", "--mirror", m.URL, m.Path); err != nil {
+			os.RemoveAll(m.Path)
+			return err
+		}
+	} else {
+		if _, err := creds.output(m.Path, "remote", "update", "--prune"); err != nil {
+			return err
+		}
+		if _, err := gitOutput(m.Path, "gc", "--auto"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mirrorCheckout clones sha from the mirror of url into the current directory. The clone hardlinks the
+// mirror's object files rather than borrowing them, so it's unaffected by the mirror being gc'd or dropped
+// once it's unlocked. Objects are copied instead when MirrorDir is on another filesystem.
+func mirrorCheckout(creds *credentialSession, m *Mirror, sha string, opts CheckoutOptions) {
+	if !m.exists() || !m.hasCommit(sha) {
+		if err := m.Update(creds); err != nil {
+			panic(err)
+		}
+	}
+	if !m.hasCommit(sha) {
+		panic("sha " + sha + " not found in repository!")
+	}
+
+	cmd := exec.Command("git", "clone", "--local", "--no-checkout", m.Path, ".")
+	util.EchoExec(cmd)
+
+	// point origin back at the real repository so relative submodule urls resolve
+	cmd = exec.Command("git", "remote", "set-url", "origin", m.URL)
+	util.EchoExec(cmd)
+
+	setSparse(opts.SparsePaths)
+
+	cmd = exec.Command("git", "reset", "--hard", sha)
+	util.EchoExec(cmd)
+
+	updateSubmodules(creds, opts.SparsePaths)
+}
+
+// DropMirror deletes the mirror of url. It waits for checkouts from the mirror to finish.
+func DropMirror(url string) error {
+	if MirrorDir == "" {
+		return ErrMirrorsDisabled
+	}
+	m, err := LockMirror(url)
+	if err != nil {
+		return err
+	}
+	defer m.Unlock()
+	exists := m.exists()
+	if err := os.RemoveAll(m.Path); err != nil {
+		return err
+	}
+	os.Remove(m.lock.Name())
+	if !exists {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// PruneMirrors deletes the mirrors that haven't been used for maxAge and returns their URLs. Mirrors in use
+// are skipped.
+func PruneMirrors(maxAge time.Duration) ([]string, error) {
+	pruned := []string{}
+	if MirrorDir == "" {
+		return pruned, nil
+	}
+	files, err := ioutil.ReadDir(MirrorDir)
+	if err != nil {
+		return pruned, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".lock") || time.Since(file.ModTime()) < maxAge {
+			continue
+		}
+		m, err := openMirror(strings.TrimSuffix(file.Name(), ".lock"), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			continue
+		}
+		// it may have been used since it was listed
+		if info, err := m.lock.Stat(); err != nil || time.Since(info.ModTime()) < maxAge {
+			m.Unlock()
+			continue
+		}
+		url, _ := ioutil.ReadFile(m.lock.Name())
+		if err := os.RemoveAll(m.Path); err != nil {
+			m.Unlock()
+			return pruned, err
+		}
+		os.Remove(m.lock.Name())
+		m.Unlock()
+		pruned = append(pruned, string(url))
+	}
+	return pruned, nil
+}
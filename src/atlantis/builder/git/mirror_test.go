@@ -0,0 +1,268 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mirrorFixture is an origin repository reachable with a file:// URL and an empty MirrorDir, both in a
+// temp directory, so mirrors can be tested offline.
+type mirrorFixture struct {
+	t      *testing.T
+	tmp    string
+	origin string
+	url    string
+}
+
+func newMirrorFixture(t *testing.T) *mirrorFixture {
+	tmp, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		os.Setenv(env, "atlantis")
+	}
+	for _, env := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		os.Setenv(env, "atlantis@example.com")
+	}
+	f := &mirrorFixture{t: t, tmp: tmp, origin: path.Join(tmp, "origin")}
+	f.url = "file://" + f.origin
+	f.git(tmp, "init", "-q", f.origin)
+	f.git(f.origin, "symbolic-ref", "HEAD", "refs/heads/master")
+	MirrorDir = path.Join(tmp, "mirrors")
+	return f
+}
+
+func (f *mirrorFixture) Close() {
+	MirrorDir = ""
+	os.RemoveAll(f.tmp)
+}
+
+func (f *mirrorFixture) git(dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		f.t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit commits fname to the origin and returns the new sha.
+func (f *mirrorFixture) commit(fname string) string {
+	if err := ioutil.WriteFile(path.Join(f.origin, fname), []byte(fname), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+	f.git(f.origin, "add", fname)
+	f.git(f.origin, "commit", "-q", "-m", fname)
+	return f.git(f.origin, "rev-parse", "HEAD")
+}
+
+func (f *mirrorFixture) lock() *Mirror {
+	m, err := LockMirror(f.url)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return m
+}
+
+func TestMirrorUpdate(t *testing.T) {
+	f := newMirrorFixture(t)
+	defer f.Close()
+	first := f.commit("first")
+
+	m := f.lock()
+	defer m.Unlock()
+	if m.exists() {
+		t.Fatalf("mirror exists before its first update")
+	}
+	if err := m.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !m.hasCommit(first) {
+		t.Errorf("cloned mirror doesn't have %s", first)
+	}
+
+	second := f.commit("second")
+	if m.hasCommit(second) {
+		t.Fatalf("mirror has %s before it's updated", second)
+	}
+	if err := m.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !m.hasCommit(second) {
+		t.Errorf("updated mirror doesn't have %s", second)
+	}
+}
+
+func TestMirrorCheckout(t *testing.T) {
+	f := newMirrorFixture(t)
+	defer f.Close()
+	f.commit("first")
+	sha := f.commit("second")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	cloneDir := path.Join(f.tmp, "clone")
+	if err := os.Mkdir(cloneDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	info := Checkout(f.url, sha, cloneDir, CheckoutOptions{})
+	if info.Sha != sha || len(info.RevList) != 2 {
+		t.Errorf("checkout of %s has sha %s and rev list %v", sha, info.Sha, info.RevList)
+	}
+	if data, err := ioutil.ReadFile(path.Join(cloneDir, "second")); err != nil || string(data) != "second" {
+		t.Errorf("second wasn't checked out: %v", err)
+	}
+	if origin := f.git(cloneDir, "config", "remote.origin.url"); origin != f.url {
+		t.Errorf("clone's origin is %s rather than %s", origin, f.url)
+	}
+
+	// the clone has its own objects, so it outlives the mirror
+	if err := DropMirror(f.url); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(cloneDir, ".git/objects/info/alternates")); err == nil {
+		t.Errorf("clone borrows objects from the mirror")
+	}
+	f.git(cloneDir, "fsck", "--full")
+	f.git(cloneDir, "log", "--oneline", sha)
+}
+
+func TestResolveShortShaFromMirror(t *testing.T) {
+	f := newMirrorFixture(t)
+	defer f.Close()
+	first := f.commit("first")
+
+	if _, err := ResolveRef(f.url, first[:7]); err == nil {
+		t.Errorf("short sha resolved without a mirror")
+	}
+	m := f.lock()
+	if err := m.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	m.Unlock()
+
+	// the mirror is brought up to date for shas it doesn't have yet
+	second := f.commit("second")
+	cases := []struct {
+		ref, sha string
+	}{
+		{first[:7], first},
+		{second[:10], second},
+		{"master", second},
+		{second, second},
+	}
+	for _, c := range cases {
+		if sha, err := ResolveRef(f.url, c.ref); err != nil || sha != c.sha {
+			t.Errorf("%s resolved to %q (%v), expected %s", c.ref, sha, err, c.sha)
+		}
+	}
+}
+
+func TestDropMirror(t *testing.T) {
+	f := newMirrorFixture(t)
+	defer f.Close()
+	f.commit("first")
+
+	m := f.lock()
+	if err := m.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	m.Unlock()
+
+	if err := DropMirror(f.url); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(m.Path); !os.IsNotExist(err) {
+		t.Errorf("dropped mirror still exists")
+	}
+	if err := DropMirror(f.url); !os.IsNotExist(err) {
+		t.Errorf("dropping a missing mirror returned %v", err)
+	}
+	MirrorDir = ""
+	if err := DropMirror(f.url); err != ErrMirrorsDisabled {
+		t.Errorf("dropping a mirror without mirrors returned %v", err)
+	}
+}
+
+func TestPruneMirrors(t *testing.T) {
+	f := newMirrorFixture(t)
+	defer f.Close()
+	f.commit("first")
+
+	m := f.lock()
+	if err := m.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	// in use, so skipped
+	if pruned, err := PruneMirrors(0); err != nil || len(pruned) != 0 {
+		t.Errorf("pruned %v (%v) while the mirror is locked", pruned, err)
+	}
+	m.Unlock()
+
+	// recently used, so skipped
+	if pruned, err := PruneMirrors(time.Hour); err != nil || len(pruned) != 0 {
+		t.Errorf("pruned %v (%v) of a mirror used just now", pruned, err)
+	}
+
+	pruned, err := PruneMirrors(0)
+	if err != nil || len(pruned) != 1 || pruned[0] != f.url {
+		t.Errorf("pruned %v (%v), expected %s", pruned, err, f.url)
+	}
+	if _, err := os.Stat(m.Path); !os.IsNotExist(err) {
+		t.Errorf("pruned mirror still exists")
+	}
+}
+
+// A mirror dropped while another build waits for it must not leave that build holding a lock on the
+// removed lock file, which the next build wouldn't see.
+func TestLockMirrorAfterDrop(t *testing.T) {
+	f := newMirrorFixture(t)
+	defer f.Close()
+
+	first := f.lock()
+	locked := make(chan *Mirror)
+	go func() {
+		m, err := LockMirror(f.url)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- m
+	}()
+	// give the waiter time to open the lock file that's about to be removed
+	time.Sleep(100 * time.Millisecond)
+	os.Remove(first.lock.Name())
+	first.Unlock()
+
+	waiter := <-locked
+	defer waiter.Unlock()
+	held, err := waiter.lock.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := os.Stat(waiter.lock.Name())
+	if err != nil || !os.SameFile(held, current) {
+		t.Errorf("waiter holds a lock file that's no longer the mirror's (%v)", err)
+	}
+}
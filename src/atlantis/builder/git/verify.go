@@ -0,0 +1,85 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package git
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// SignaturePolicy says which commits may be built. When Required, the commit being built, or an annotated
+// tag pointing at it, has to be signed by one of the public keys in the GnuPG home directory GPGHome or by
+// one of the SSH keys in the allowed signers file SSHAllowedSigners.
+type SignaturePolicy struct {
+	Required          bool   `toml:"required"`
+	GPGHome           string `toml:"gpg_home"`
+	SSHAllowedSigners string `toml:"ssh_allowed_signers"`
+}
+
+// Signatures is checked against every checkout. Signatures aren't checked at all when it's nil and are
+// only recorded in Info when it isn't Required.
+var Signatures *SignaturePolicy
+
+// Verification is the outcome of checking the signatures on a checked out sha.
+type Verification struct {
+	Verified bool   `json:"verified"`
+	Object   string `json:"object,omitempty"`
+	Signer   string `json:"signer,omitempty"`
+	Output   string `json:"output,omitempty"`
+}
+
+var gpgSignerRegex = regexp.MustCompile(`Good signature from "([^"]+)"`)
+var sshSignerRegex = regexp.MustCompile(`Good "git" signature for (\S+) with (.+)`)
+
+// verifyObject runs git verify-commit or verify-tag, which succeed only for a good signature by a key the
+// policy trusts, and pulls the signer out of what gpg or ssh-keygen printed.
+func (p *SignaturePolicy) verifyObject(kind, object string) *Verification {
+	args := []string{}
+	if p.SSHAllowedSigners != "" {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+p.SSHAllowedSigners)
+	}
+	args = append(args, "verify-"+kind, object)
+	cmd := exec.Command("git", args...)
+	cmd.Env = os.Environ()
+	if p.GPGHome != "" {
+		cmd.Env = append(cmd.Env, "GNUPGHOME="+p.GPGHome)
+	}
+	out, err := cmd.CombinedOutput()
+
+	v := &Verification{Verified: err == nil, Object: object, Output: strings.TrimSpace(string(out))}
+	if match := gpgSignerRegex.FindStringSubmatch(v.Output); match != nil {
+		v.Signer = match[1]
+	} else if match := sshSignerRegex.FindStringSubmatch(v.Output); match != nil {
+		v.Signer = match[1] + " (" + match[2] + ")"
+	}
+	return v
+}
+
+// Verify checks the signature on sha and, if that isn't trusted, on the annotated tags in refs. It
+// returns the first trusted signature found, or the commit's verification when there is none.
+func (p *SignaturePolicy) Verify(sha string, refs []string) *Verification {
+	v := p.verifyObject("commit", sha)
+	if v.Verified {
+		return v
+	}
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref, "refs/tags/") {
+			continue
+		}
+		if tv := p.verifyObject("tag", ref); tv.Verified {
+			return tv
+		}
+	}
+	return v
+}
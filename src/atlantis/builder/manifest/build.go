@@ -0,0 +1,26 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package manifest
+
+// BuildResources is the [build] table of a manifest, which asks for resources for the container the app is
+// built in, as opposed to cpu_shares and memory_limit which are for the app when it runs. Limits that
+// aren't given are the builder's defaults and none may be more than the builder allows. MemoryLimit is in
+// MB. Privileged is only honoured when the builder allows privileged builds, and can be set to false to
+// opt out of one. IsolateNetwork cuts the build off from everything but the builder's dependency proxies,
+// and builds unprivileged.
+type BuildResources struct {
+	CPUShares      uint  `toml:"cpu_shares"`
+	MemoryLimit    uint  `toml:"memory_limit"`
+	PidsLimit      uint  `toml:"pids_limit"`
+	Privileged     *bool `toml:"privileged"`
+	IsolateNetwork bool  `toml:"isolate_network"`
+}
@@ -0,0 +1,125 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	HealthCheckHTTP    = "http"
+	HealthCheckTCP     = "tcp"
+	HealthCheckCommand = "command"
+
+	DefaultHealthCheckInterval = 10
+	DefaultHealthCheckTimeout  = 5
+
+	DefaultSmokeTestTimeout = 120
+	MaxSmokeTestTimeout     = 1800
+)
+
+// HealthCheck is one [[health_checks]] entry of a manifest. The type is inferred from the other fields
+// when it isn't given: a command makes it a command check, a path an http check and a bare port a tcp
+// check. Interval and Timeout are in seconds.
+type HealthCheck struct {
+	Type     string `toml:"type" json:"type"`
+	Path     string `toml:"path" json:"path,omitempty"`
+	Port     uint16 `toml:"port" json:"port,omitempty"`
+	Command  string `toml:"command" json:"command,omitempty"`
+	Interval uint   `toml:"interval" json:"interval"`
+	Timeout  uint   `toml:"timeout" json:"timeout"`
+}
+
+func (c *HealthCheck) Validate() error {
+	c.Type = strings.ToLower(c.Type)
+	if c.Type == "" {
+		if c.Command != "" {
+			c.Type = HealthCheckCommand
+		} else if c.Path != "" {
+			c.Type = HealthCheckHTTP
+		} else {
+			c.Type = HealthCheckTCP
+		}
+	}
+	switch c.Type {
+	case HealthCheckHTTP:
+		if c.Port == 0 {
+			return errors.New("An http health check requires a port!")
+		}
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		if !strings.HasPrefix(c.Path, "/") || strings.IndexFunc(c.Path, isSpaceOrControl) >= 0 {
+			return errors.New(fmt.Sprintf("Invalid health check path %q! It must start with / and can't have spaces.", c.Path))
+		}
+		if c.Command != "" {
+			return errors.New("An http health check can't have a command!")
+		}
+	case HealthCheckTCP:
+		if c.Port == 0 {
+			return errors.New("A tcp health check requires a port!")
+		}
+		if c.Path != "" || c.Command != "" {
+			return errors.New("A tcp health check can only have a port!")
+		}
+	case HealthCheckCommand:
+		if c.Command == "" {
+			return errors.New("A command health check requires a command!")
+		}
+		if c.Path != "" || c.Port != 0 {
+			return errors.New("A command health check can't have a path or port!")
+		}
+	default:
+		return errors.New(fmt.Sprintf("Invalid health check type %s! Please use http, tcp or command.", c.Type))
+	}
+	if c.Interval == 0 {
+		c.Interval = DefaultHealthCheckInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultHealthCheckTimeout
+	}
+	if c.Timeout > c.Interval {
+		return errors.New(fmt.Sprintf("Health check timeout %ds is longer than its interval %ds!", c.Timeout, c.Interval))
+	}
+	return nil
+}
+
+func (man *Data) ValidateHealthChecks() error {
+	for idx := range man.HealthChecks {
+		if err := man.HealthChecks[idx].Validate(); err != nil {
+			return errors.New(fmt.Sprintf("Invalid health check %d: %s", idx, err.Error()))
+		}
+	}
+	return nil
+}
+
+// SmokeTest is the [smoke_test] table of a manifest. When enabled, the built image is started and must
+// pass its health checks and then its smoke test commands within Timeout seconds before it is pushed. It
+// only runs when enabled: declaring health checks doesn't enable it, they're also what the Atlantis
+// manager probes running apps with.
+type SmokeTest struct {
+	Enabled  bool     `toml:"enabled"`
+	Timeout  uint     `toml:"timeout"`
+	Commands []string `toml:"commands"`
+}
+
+func (t *SmokeTest) Validate() error {
+	if t.Timeout == 0 {
+		t.Timeout = DefaultSmokeTestTimeout
+	}
+	if t.Timeout > MaxSmokeTestTimeout {
+		return errors.New(fmt.Sprintf("Invalid smoke_test.timeout %d! Must be at most %d seconds.", t.Timeout, MaxSmokeTestTimeout))
+	}
+	return nil
+}
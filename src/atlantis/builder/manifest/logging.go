@@ -0,0 +1,191 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	// vendored packages
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	LogFormatPlain = "plain"
+	LogFormatJSON  = "json"
+)
+
+var ForwardProtocols = map[string]uint16{"tcp": 514, "udp": 514, "relp": 2514}
+
+var (
+	hostnameRegex  = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9\-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9\-]*[A-Za-z0-9])?)*\.?$`)
+	diskSpaceRegex = regexp.MustCompile(`^[0-9]+[kKmMgGtT]?$`)
+	// the peer is matched against certificate names, which may be wildcards
+	peerRegex = regexp.MustCompile(`^[A-Za-z0-9*.\-]+$`)
+)
+
+// LogForward describes where rsyslog in the app container ships the app's logs. It is used both for the
+// builderd wide default and for the [logging.forward] table of a manifest, which replaces the default.
+// Everything in it ends up in an rsyslog config, so Validate only lets through values that can't add
+// directives to it. RetryCount is how often a failed send is retried, forever when it isn't set.
+type LogForward struct {
+	Disabled          bool   `toml:"disabled"`
+	Protocol          string `toml:"protocol"`
+	Host              string `toml:"host"`
+	Port              uint16 `toml:"port"`
+	QueueSize         uint   `toml:"queue_size"`
+	QueueMaxDiskSpace string `toml:"queue_max_disk_space"`
+	RetryCount        *int   `toml:"retry_count"`
+	TLS               bool   `toml:"tls"`
+	TLSCAFile         string `toml:"tls_ca_file"`
+	TLSPermittedPeer  string `toml:"tls_permitted_peer"`
+}
+
+func (f *LogForward) Validate() error {
+	if f.Disabled {
+		return nil
+	}
+	f.Protocol = strings.ToLower(f.Protocol)
+	if f.Protocol == "" {
+		f.Protocol = "tcp"
+	}
+	defaultPort, ok := ForwardProtocols[f.Protocol]
+	if !ok {
+		return errors.New(fmt.Sprintf("Invalid log forward protocol %s! Please use tcp, udp or relp.", f.Protocol))
+	}
+	if f.Port == 0 {
+		f.Port = defaultPort
+	}
+	if f.Host == "" {
+		return errors.New("Log forwarding requires a host!")
+	}
+	if net.ParseIP(f.Host) == nil && (len(f.Host) > 253 || !hostnameRegex.MatchString(f.Host)) {
+		return errors.New(fmt.Sprintf("Invalid log forward host %q! Please use a hostname or IP address.", f.Host))
+	}
+	if f.QueueSize == 0 {
+		f.QueueSize = 10000
+	}
+	if f.QueueMaxDiskSpace == "" {
+		f.QueueMaxDiskSpace = "1g"
+	}
+	if !diskSpaceRegex.MatchString(f.QueueMaxDiskSpace) {
+		return errors.New(fmt.Sprintf("Invalid log forward queue_max_disk_space %q! Please use a size like 512m or 1g.", f.QueueMaxDiskSpace))
+	}
+	if f.RetryCount != nil && *f.RetryCount < 0 {
+		return errors.New(fmt.Sprintf("Invalid log forward retry_count %d! Leave it out to retry forever.", *f.RetryCount))
+	}
+	if f.TLS {
+		if f.Protocol != "tcp" {
+			return errors.New("Log forwarding over TLS is only supported with tcp!")
+		}
+		if f.TLSCAFile == "" {
+			return errors.New("Log forwarding over TLS requires tls_ca_file!")
+		}
+		if strings.IndexFunc(f.TLSCAFile, isSpaceOrControl) >= 0 {
+			return errors.New(fmt.Sprintf("Invalid log forward tls_ca_file %q! Paths can't have spaces or control characters.", f.TLSCAFile))
+		}
+		if f.TLSPermittedPeer != "" && !peerRegex.MatchString(f.TLSPermittedPeer) {
+			return errors.New(fmt.Sprintf("Invalid log forward tls_permitted_peer %q! Please use a certificate name.", f.TLSPermittedPeer))
+		}
+	}
+	return nil
+}
+
+// isSpaceOrControl finds what would end a value in an rsyslog legacy directive, which runs to the end of
+// the line and is cut at the first space.
+func isSpaceOrControl(r rune) bool {
+	return r <= ' ' || r == 0x7f
+}
+
+const (
+	MinLogMaxSize = 1 << 20
+	MaxLogMaxSize = 10 << 30
+	MaxLogKeep    = 10000
+	MaxLogMaxAge  = 3650
+)
+
+// LogRotation is the [logging.rotation] table of a manifest. MaxSize is in bytes and is used both as the
+// rsyslog outchannel limit and the logrotate size, Keep of 0 keeps every rotated file and MaxAge is in days.
+type LogRotation struct {
+	MaxSize  uint64 `toml:"max_size"`
+	Keep     uint   `toml:"keep"`
+	MaxAge   uint   `toml:"max_age"`
+	Compress *bool  `toml:"compress"`
+}
+
+func DefaultLogRotation() LogRotation {
+	return LogRotation{MaxSize: 10485760}
+}
+
+func (r LogRotation) Compressed() bool {
+	return r.Compress == nil || *r.Compress
+}
+
+func (r *LogRotation) Validate() error {
+	if r.MaxSize == 0 {
+		r.MaxSize = DefaultLogRotation().MaxSize
+	}
+	if r.MaxSize < MinLogMaxSize || r.MaxSize > MaxLogMaxSize {
+		return errors.New(fmt.Sprintf("Invalid logging.rotation.max_size %d! Must be between %d and %d bytes.", r.MaxSize, MinLogMaxSize, MaxLogMaxSize))
+	}
+	if r.Keep > MaxLogKeep {
+		return errors.New(fmt.Sprintf("Invalid logging.rotation.keep %d! Must be at most %d.", r.Keep, MaxLogKeep))
+	}
+	if r.MaxAge > MaxLogMaxAge {
+		return errors.New(fmt.Sprintf("Invalid logging.rotation.max_age %d! Must be at most %d days.", r.MaxAge, MaxLogMaxAge))
+	}
+	return nil
+}
+
+// readLogging splits the [logging] table into the custom facility tables (local0-7) and the logging
+// options that apply to all of the app's log files.
+func readLogging(md toml.MetaData, manifest *Data) error {
+	manifest.Logging = map[string]map[string]string{}
+	manifest.LogFormat = LogFormatPlain
+	manifest.LogRotation = DefaultLogRotation()
+	for key, prim := range manifest.RawLogging {
+		switch key {
+		case "format":
+			if err := md.PrimitiveDecode(prim, &manifest.LogFormat); err != nil {
+				return errors.New(fmt.Sprintf("Invalid logging.format: %s", err.Error()))
+			}
+		case "forward":
+			manifest.LogForward = &LogForward{}
+			if err := md.PrimitiveDecode(prim, manifest.LogForward); err != nil {
+				return errors.New(fmt.Sprintf("Invalid logging.forward: %s", err.Error()))
+			}
+			if err := manifest.LogForward.Validate(); err != nil {
+				return err
+			}
+		case "rotation":
+			if err := md.PrimitiveDecode(prim, &manifest.LogRotation); err != nil {
+				return errors.New(fmt.Sprintf("Invalid logging.rotation: %s", err.Error()))
+			}
+			if err := manifest.LogRotation.Validate(); err != nil {
+				return err
+			}
+		default:
+			facProps := map[string]string{}
+			if err := md.PrimitiveDecode(prim, &facProps); err != nil {
+				return errors.New(fmt.Sprintf("Invalid logging facility %s: %s", key, err.Error()))
+			}
+			manifest.Logging[key] = facProps
+		}
+	}
+	manifest.LogFormat = strings.ToLower(manifest.LogFormat)
+	if manifest.LogFormat != LogFormatPlain && manifest.LogFormat != LogFormatJSON {
+		return errors.New(fmt.Sprintf("Invalid logging.format %s! Please use %s or %s.", manifest.LogFormat, LogFormatPlain, LogFormatJSON))
+	}
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"path"
 	"regexp"
 	"strings"
 	// vendored packages
@@ -22,17 +23,31 @@ import (
 )
 
 type Data struct {
-	Name          string                       `toml:"name"`
-	Description   string                       `toml:"description"`
-	Internal      bool                         `toml:"internal"`
-	AppType       string                       `toml:"app_type"`
-	JavaType      string                       `toml:"java_type"`
-	RunCommands   []string                     `toml:"run_commands"`
-	Dependencies  []string                     `toml:"dependencies"`
-	SetupCommands []string                     `toml:"setup_commands"`
-	CPUShares     uint                         `toml:"cpu_shares"`
-	MemoryLimit   uint                         `toml:"memory_limit"`
-	Logging       map[string]map[string]string `toml:"logging"`
+	Name          string                    `toml:"name"`
+	Description   string                    `toml:"description"`
+	Internal      bool                      `toml:"internal"`
+	AppType       string                    `toml:"app_type"`
+	JavaType      string                    `toml:"java_type"`
+	RunCommands   []string                  `toml:"run_commands"`
+	Dependencies  []string                  `toml:"dependencies"`
+	SetupCommands []string                  `toml:"setup_commands"`
+	CPUShares     uint                      `toml:"cpu_shares"`
+	MemoryLimit   uint                      `toml:"memory_limit"`
+	RawLogging    map[string]toml.Primitive `toml:"logging"`
+	HealthChecks  []HealthCheck             `toml:"health_checks"`
+	SmokeTest     SmokeTest                 `toml:"smoke_test"`
+	TestCommands  []string                  `toml:"test_commands"`
+	TestResults   []string                  `toml:"test_results"`
+	TestTimeout   uint                      `toml:"test_timeout"`
+	SourcePaths   []string                  `toml:"source_paths"`
+	GitLFS        bool                      `toml:"git_lfs"`
+	Build         BuildResources            `toml:"build"`
+
+	// Populated from RawLogging: facility tables go to Logging, the rest are logging options.
+	Logging     map[string]map[string]string `toml:"-"`
+	LogFormat   string                       `toml:"-"`
+	LogForward  *LogForward                  `toml:"-"`
+	LogRotation LogRotation                  `toml:"-"`
 
 	// FIXME(manas) Deprecated, TBD.
 	RunCommand interface{} `toml:"run_command"`
@@ -40,24 +55,52 @@ type Data struct {
 
 func Read(r io.Reader) (*Data, error) {
 	var manifest Data
-	if _, err := toml.DecodeReader(r, &manifest); err != nil {
+	md, err := toml.DecodeReader(r, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := finishRead(md, &manifest); err != nil {
 		return nil, err
 	}
-
-	fixCompat(&manifest)
 	return &manifest, nil
 }
 
 func ReadFile(fname string) (*Data, error) {
 	var manifest Data
-	if _, err := toml.DecodeFile(fname, &manifest); err != nil {
+	md, err := toml.DecodeFile(fname, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := finishRead(md, &manifest); err != nil {
 		return nil, err
 	}
-
-	fixCompat(&manifest)
 	return &manifest, nil
 }
 
+// finishRead fills in and validates the parts of the manifest that can't be decoded directly.
+func finishRead(md toml.MetaData, manifest *Data) error {
+	if err := readLogging(md, manifest); err != nil {
+		return err
+	}
+	if err := manifest.ValidateHealthChecks(); err != nil {
+		return err
+	}
+	if err := manifest.SmokeTest.Validate(); err != nil {
+		return err
+	}
+	if err := manifest.ValidateTests(); err != nil {
+		return err
+	}
+	for _, p := range manifest.SourcePaths {
+		if clean := path.Clean(p); strings.HasPrefix(p, "/") || clean == ".." || strings.HasPrefix(clean, "../") {
+			return errors.New(fmt.Sprintf("Invalid source path %s! Source paths are relative to the root of the repository.", p))
+		}
+	}
+
+	fixCompat(manifest)
+	return nil
+}
+
 var LoggingKeys = map[string]bool{"name": true, "panic": true, "alert": true, "crit": true, "error": true, "warn": true, "notice": true, "info": true, "debug": true}
 
 func (man *Data) ValidateFacility(fac string) error {
@@ -88,6 +131,29 @@ func (man *Data) ValidateFacility(fac string) error {
 	return nil
 }
 
+const (
+	DefaultTestTimeout = 600
+	MaxTestTimeout     = 3600
+)
+
+// ValidateTests checks the test timeout and the test_results globs, which are expanded by bash relative to
+// the app's source when the tests are done.
+func (man *Data) ValidateTests() error {
+	if man.TestTimeout == 0 {
+		man.TestTimeout = DefaultTestTimeout
+	}
+	if man.TestTimeout > MaxTestTimeout {
+		return errors.New(fmt.Sprintf("Invalid test_timeout %d! Must be at most %d seconds.", man.TestTimeout, MaxTestTimeout))
+	}
+	globRegex := regexp.MustCompile("^[\\w\\-.*/]+$")
+	for _, glob := range man.TestResults {
+		if !globRegex.MatchString(glob) || strings.HasPrefix(glob, "/") || strings.Contains(glob, "..") {
+			return errors.New(fmt.Sprintf("Invalid test result path %s! Please use relative paths and * globs only.", glob))
+		}
+	}
+	return nil
+}
+
 func fixCompat(manifest *Data) {
 	app_type := strings.Split(manifest.AppType, "-")
 	if strings.HasPrefix(app_type[0], "java") && len(app_type) > 1 {
@@ -12,9 +12,14 @@
 package template
 
 import (
+	"atlantis/builder/manifest"
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"sort"
 	"strings"
 	"text/template"
 )
@@ -41,38 +46,105 @@ func WriteRunitScript(path string, cmd string, idx int) {
 	}
 }
 
-const RsyslogAppTemplate = `# config for app{{.}}
-$outchannel app{{.}}Info,/var/log/atlantis/app{{.}}/stdout.log,10485760,/etc/logrot
-$outchannel app{{.}}Error,/var/log/atlantis/app{{.}}/stderr.log,10485760,/etc/logrot
+// RsyslogJSONTemplate renders one JSON record per line. It is only declared in the generated configs when
+// the manifest asks for logging.format = "json", so the files under /var/log/atlantis stay where they are.
+const RsyslogJSONTemplate = `$template {{.Name}},"{\"timestamp\":\"%timereported:::date-rfc3339%\",\"app\":\"{{json .App}}\",{{.Source}}\"priority\":\"%syslogseverity-text%\",\"sha\":\"{{json .Sha}}\",\"message\":\"%msg:::json%\"}\n"
+`
+
+// rsyslogEscape makes s a literal in a quoted rsyslog $template string.
+func rsyslogEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `%`, `\%`, "\n", `\n`).Replace(s)
+}
+
+// jsonEscape makes s the contents of a JSON string in a quoted rsyslog $template string.
+func jsonEscape(s string) string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return rsyslogEscape(string(data[1 : len(data)-1]))
+}
+
+type RsyslogJSON struct {
+	Name   string
+	App    string
+	Sha    string
+	Source string
+}
 
-local{{.}}.=info  :omfile:$app{{.}}Info
+func rsyslogJSONTemplate(name, app, sha, source string) string {
+	tmpl := template.Must(template.New("rsyslogJSON").Funcs(template.FuncMap{"json": jsonEscape}).Parse(RsyslogJSONTemplate))
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, RsyslogJSON{name, app, sha, source}); err != nil {
+		panic(err)
+	}
+	return buffer.String()
+}
+
+const RsyslogAppTemplate = `# config for app{{.Num}}
+{{.JSONTemplate}}$outchannel app{{.Num}}Info,/var/log/atlantis/app{{.Num}}/stdout.log,{{.MaxSize}},/etc/logrot.d/app{{.Num}}
+$outchannel app{{.Num}}Error,/var/log/atlantis/app{{.Num}}/stderr.log,{{.MaxSize}},/etc/logrot.d/app{{.Num}}
+
+local{{.Num}}.=info  :omfile:$app{{.Num}}Info{{.Format}}
 & ~
-local{{.}}.=error :omfile:$app{{.}}Error
+local{{.Num}}.=error :omfile:$app{{.Num}}Error{{.Format}}
 & ~
-local{{.}}.=crit  :omfile:$app{{.}}Error
+local{{.Num}}.=crit  :omfile:$app{{.Num}}Error{{.Format}}
 & ~
 `
 
-func WriteRsyslogAppConfig(path string, idx int) {
+type RsyslogApp struct {
+	Num          int
+	JSONTemplate string
+	Format       string
+	MaxSize      uint64
+}
+
+// LogInfo is what the rsyslog and logrotate configs need to know about the app being built.
+type LogInfo struct {
+	App      string
+	Sha      string
+	Format   string
+	Rotation manifest.LogRotation
+}
+
+func (l LogInfo) JSON() bool {
+	return l.Format == manifest.LogFormatJSON
+}
+
+func WriteRsyslogAppConfig(path string, idx int, info LogInfo) {
+	app := RsyslogApp{Num: idx, MaxSize: info.Rotation.MaxSize}
+	if info.JSON() {
+		name := fmt.Sprintf("app%dJSON", idx)
+		app.JSONTemplate = rsyslogJSONTemplate(name, info.App, info.Sha, fmt.Sprintf(`\"process\":%d,`, idx))
+		app.Format = ";" + name
+	}
 	tmpl := template.Must(template.New("rsyslog").Parse(RsyslogAppTemplate))
 	if fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0500); err != nil {
 		panic(err)
 	} else {
-		if err := tmpl.Execute(fh, idx); err != nil {
+		if err := tmpl.Execute(fh, app); err != nil {
 			panic(err)
 		}
 	}
 }
 
-func WriteRsyslogCustomConfig(path string, fac string, desc map[string]string) {
+// WriteRsyslogCustomConfig writes the config of a custom facility. Its JSON records have the number of the
+// facility as their process, the same as the run command that logs to it would have.
+func WriteRsyslogCustomConfig(path string, fac string, desc map[string]string, info LogInfo) {
 	name := desc["name"]
 	delete(desc, "name")
 	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf(`# config for %s on %s\n`, name, fac))
+	buffer.WriteString(fmt.Sprintf("# config for %s on %s\n", name, fac))
+	format := ""
+	if info.JSON() {
+		format = ";" + fac + "JSON"
+		buffer.WriteString(rsyslogJSONTemplate(fac+"JSON", info.App, info.Sha, fmt.Sprintf(`\"process\":%s,`, strings.TrimPrefix(fac, "local"))))
+	}
 	for key, val := range desc {
 		key = strings.ToLower(key)
-		buffer.WriteString(fmt.Sprintf(`$outchannel %s%s,/var/log/atlantis/%s/%s.log,10485760,/etc/logrot\n`, fac, key, name, val))
-		buffer.WriteString(fmt.Sprintf(`%s.=%s  :omfile:$%s%s\n& ~\n`, fac, key, fac, key))
+		buffer.WriteString(fmt.Sprintf("$outchannel %s%s,/var/log/atlantis/%s/%s.log,%d,/etc/logrot.d/%s\n", fac, key, name, val, info.Rotation.MaxSize, name))
+		buffer.WriteString(fmt.Sprintf("%s.=%s  :omfile:$%s%s%s\n& ~\n", fac, key, fac, key, format))
 	}
 	if fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0500); err != nil {
 		panic(err)
@@ -83,6 +155,341 @@ func WriteRsyslogCustomConfig(path string, fac string, desc map[string]string) {
 	}
 }
 
+// LogrotateTemplate is the stanza for one of the app's log directories under /var/log/atlantis.
+const LogrotateTemplate = `/var/log/atlantis/{{.Dir}}/*.log {
+    size {{.MaxSize}}
+    rotate {{if .Keep}}{{.Keep}}{{else}}99999999999{{end}}
+{{if .MaxAge}}    maxage {{.MaxAge}}
+{{end}}    create
+    dateext
+    dateformat -%Y-%m-%d-%s
+{{if .Compressed}}    compress
+{{end}}}
+`
+
+// LogrotateScriptTemplate is what rsyslog runs when an outchannel in the directory reaches MaxSize. Each
+// directory has its own state file, so rotating one doesn't wait on or touch another.
+const LogrotateScriptTemplate = `#!/bin/sh
+exec logrotate -s /var/lib/logrotate/atlantis-{{.Dir}}.status /etc/logrot.d/{{.Dir}}.conf
+`
+
+type Logrotate struct {
+	Dir string
+	manifest.LogRotation
+}
+
+// WriteLogrotateConfigs writes /etc/logrot.d/<dir>.conf and the /etc/logrot.d/<dir> script the outchannels
+// of each log directory run, and replaces /etc/logrot.conf from the base layer with all of the stanzas,
+// sorted so the image doesn't depend on the order of the manifest's facilities.
+func WriteLogrotateConfigs(overlayDir string, dirs []string, rotation manifest.LogRotation) {
+	sorted := map[string]bool{}
+	for _, dir := range dirs {
+		sorted[dir] = true
+	}
+	dirs = []string{}
+	for dir := range sorted {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	confTmpl := template.Must(template.New("logrotate").Parse(LogrotateTemplate))
+	scriptTmpl := template.Must(template.New("logrotateScript").Parse(LogrotateScriptTemplate))
+	if err := os.MkdirAll(path.Join(overlayDir, "/etc/logrot.d"), 0755); err != nil {
+		panic(err)
+	}
+	var all bytes.Buffer
+	for _, dir := range dirs {
+		var buffer bytes.Buffer
+		if err := confTmpl.Execute(&buffer, Logrotate{dir, rotation}); err != nil {
+			panic(err)
+		}
+		all.Write(buffer.Bytes())
+		if err := ioutil.WriteFile(path.Join(overlayDir, "/etc/logrot.d", dir+".conf"), buffer.Bytes(), 0644); err != nil {
+			panic(err)
+		}
+		buffer.Reset()
+		if err := scriptTmpl.Execute(&buffer, Logrotate{Dir: dir}); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(path.Join(overlayDir, "/etc/logrot.d", dir), buffer.Bytes(), 0755); err != nil {
+			panic(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(overlayDir, "/etc/logrot.conf"), all.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+}
+
+// RsyslogForwardTemplate ships every app facility to the log aggregator. It is written as
+// /etc/rsyslog.d/00-forward.conf so it runs before the per-app configs discard their messages.
+const RsyslogForwardTemplate = `# forward app logs to {{.Fwd.Host}}:{{.Fwd.Port}} over {{.Fwd.Protocol}}
+{{if eq .Fwd.Protocol "relp"}}$ModLoad omrelp
+{{end}}{{if .Fwd.TLS}}$DefaultNetstreamDriver gtls
+$DefaultNetstreamDriverCAFile {{.Fwd.TLSCAFile}}
+$ActionSendStreamDriverMode 1
+{{if .Fwd.TLSPermittedPeer}}$ActionSendStreamDriverAuthMode x509/name
+$ActionSendStreamDriverPermittedPeer {{.Fwd.TLSPermittedPeer}}
+{{else}}$ActionSendStreamDriverAuthMode anon
+{{end}}{{end}}{{.Template}}$ActionQueueType LinkedList
+$ActionQueueFileName atlantisForward
+$ActionQueueSize {{.Fwd.QueueSize}}
+$ActionQueueMaxDiskSpace {{.Fwd.QueueMaxDiskSpace}}
+$ActionQueueSaveOnShutdown on
+$ActionResumeRetryCount {{.RetryCount}}
+local0.*;local1.*;local2.*;local3.*;local4.*;local5.*;local6.*;local7.* {{.Action}};atlantisForward
+`
+
+const RsyslogForwardPlainTemplate = `$template atlantisForward,"<%PRI%>%TIMESTAMP:::date-rfc3339% %HOSTNAME% {{rsyslog .App}}-{{rsyslog .Sha}}[%syslogfacility-text%]: %msg%\n"
+`
+
+type RsyslogForward struct {
+	Fwd        *manifest.LogForward
+	Template   string
+	Action     string
+	RetryCount int
+}
+
+func WriteRsyslogForwardConfig(path string, fwd *manifest.LogForward, info LogInfo) {
+	// rsyslog retries forever with -1
+	forward := RsyslogForward{Fwd: fwd, RetryCount: -1}
+	if fwd.RetryCount != nil {
+		forward.RetryCount = *fwd.RetryCount
+	}
+	host := fwd.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	switch fwd.Protocol {
+	case "udp":
+		forward.Action = fmt.Sprintf("@%s:%d", host, fwd.Port)
+	case "relp":
+		forward.Action = fmt.Sprintf(":omrelp:%s:%d", host, fwd.Port)
+	default:
+		forward.Action = fmt.Sprintf("@@%s:%d", host, fwd.Port)
+	}
+	if info.JSON() {
+		forward.Template = rsyslogJSONTemplate("atlantisForward", info.App, info.Sha, `\"facility\":\"%syslogfacility-text%\",`)
+	} else {
+		tmpl := template.Must(template.New("rsyslogForwardPlain").Funcs(template.FuncMap{"rsyslog": rsyslogEscape}).Parse(RsyslogForwardPlainTemplate))
+		var buffer bytes.Buffer
+		if err := tmpl.Execute(&buffer, info); err != nil {
+			panic(err)
+		}
+		forward.Template = buffer.String()
+	}
+	tmpl := template.Must(template.New("rsyslogForward").Parse(RsyslogForwardTemplate))
+	if fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0500); err != nil {
+		panic(err)
+	} else {
+		if err := tmpl.Execute(fh, forward); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// HealthCheckTemplate probes every declared health check once and exits non-zero if any of them fails,
+// so it can be run by the Atlantis manager, a load balancer agent or the builder itself. Only bash is
+// needed, which every base layer has: http checks speak HTTP/1.0 over /dev/tcp and pass on any status
+// below 400.
+const HealthCheckTemplate = `#!/bin/bash
+# health checks for {{.App}}
+http_check() {
+  { exec 3<>"/dev/tcp/localhost/$1"; } 2>/dev/null || return 1
+  printf 'GET %s HTTP/1.0\r\nHost: localhost:%s\r\nConnection: close\r\n\r\n' "$2" "$1" >&3
+  read -r proto code rest <&3
+  [[ "$code" =~ ^[0-9]{3}$ ]] && [ "$code" -lt 400 ]
+}
+export -f http_check
+status=0
+{{range $idx, $check := .Checks}}
+# check {{$idx}}: {{$check.Type}} every {{$check.Interval}}s, timeout {{$check.Timeout}}s
+{{if eq $check.Type "http"}}if ! timeout {{$check.Timeout}} bash -c {{quote (printf "http_check %d %s" $check.Port (quote $check.Path))}}; then
+{{else if eq $check.Type "tcp"}}if ! timeout {{$check.Timeout}} bash -c {{quote (printf "</dev/tcp/localhost/%d" $check.Port)}}; then
+{{else}}if ! timeout {{$check.Timeout}} bash -c {{quote $check.Command}}; then
+{{end}}  echo "health check {{$idx}} ({{$check.Type}}) failed"
+  status=1
+fi
+{{end}}
+exit $status
+`
+
+type HealthChecks struct {
+	App    string
+	Checks []manifest.HealthCheck
+}
+
+// shellQuote single quotes s for bash.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func WriteHealthCheckScript(path string, app string, checks []manifest.HealthCheck) {
+	tmpl := template.Must(template.New("health").Funcs(template.FuncMap{"quote": shellQuote}).Parse(HealthCheckTemplate))
+	if fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0555); err != nil {
+		panic(err)
+	} else {
+		if err := tmpl.Execute(fh, HealthChecks{app, checks}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// WriteHealthCheckInfo writes the health checks as JSON so they can be discovered from the image.
+func WriteHealthCheckInfo(path string, checks []manifest.HealthCheck) {
+	if checks == nil {
+		checks = []manifest.HealthCheck{}
+	}
+	data, err := json.MarshalIndent(checks, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		panic(err)
+	}
+}
+
+// SmokeTestTemplate is run as the command of a container started from the freshly built app image. It brings
+// up runit, waits for the health checks to pass, runs the smoke test commands and dumps the app's logs.
+const SmokeTestTemplate = `#!/bin/bash
+# smoke test for {{.App}}
+runsvdir -P /etc/service &
+
+status=0
+deadline=$(( $(date +%s) + {{.Timeout}} ))
+until /etc/atlantis/scripts/health_check > /tmp/health_check.out 2>&1; do
+  if [ $(date +%s) -ge $deadline ]; then
+    cat /tmp/health_check.out
+    echo "health checks did not pass within {{.Timeout}}s"
+    status=1
+    break
+  fi
+  sleep 2
+done
+{{range .Commands}}
+if [ $status -eq 0 ]; then
+  echo "running smoke test: "{{quote .}}
+  remaining=$(( deadline - $(date +%s) ))
+  if [ $remaining -le 0 ] || ! timeout $remaining bash -c {{quote .}}; then
+    echo "smoke test failed: "{{quote .}}
+    status=1
+  fi
+fi
+{{end}}
+for log in /var/log/atlantis/*/*.log; do
+  [ -f "$log" ] || continue
+  echo "==> $log <=="
+  tail -n 100 "$log"
+done
+exit $status
+`
+
+type SmokeTest struct {
+	App      string
+	Timeout  uint
+	Commands []string
+}
+
+func WriteSmokeTestScript(path string, app string, smoke manifest.SmokeTest) {
+	tmpl := template.Must(template.New("smoke").Funcs(template.FuncMap{"quote": shellQuote}).Parse(SmokeTestTemplate))
+	if fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0555); err != nil {
+		panic(err)
+	} else {
+		if err := tmpl.Execute(fh, SmokeTest{app, smoke.Timeout, smoke.Commands}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// TestTemplate runs the manifest's test commands in a container from the builder layer. The app's source is
+// bind mounted at /overlay/src and the test result files are copied to /overlay/results.
+const TestTemplate = `#!/bin/bash
+# tests for {{.App}}
+exec 2>&1
+cd /overlay/src
+/overlay/setup
+
+status=0
+{{range .Commands}}
+if [ $status -eq 0 ]; then
+  echo "running test: "{{quote .}}
+  bash -c {{quote .}} || status=$?
+fi
+{{end}}
+mkdir -p /overlay/results
+shopt -s globstar nullglob
+{{range .Results}}for result in {{.}}; do
+  cp --parents "$result" /overlay/results/
+done
+{{end}}
+exit $status
+`
+
+type Tests struct {
+	App      string
+	Commands []string
+	Results  []string
+}
+
+func WriteTestScript(path string, app string, commands, results []string) {
+	tmpl := template.Must(template.New("tests").Funcs(template.FuncMap{"quote": shellQuote}).Parse(TestTemplate))
+	if fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0555); err != nil {
+		panic(err)
+	} else {
+		if err := tmpl.Execute(fh, Tests{app, commands, results}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// ReproducibleTemplate wraps the build script in reproducible mode. Everything the build changed outside the
+// pseudo filesystems and bind mounts gets its mtime set to SOURCE_DATE_EPOCH, then the path, type, mode,
+// owner and content of every file in the image, changed or not, is listed in .reproducible/content.txt and
+// its sha256 written to .reproducible/digest, so files the build deleted change the digest too. The files
+// docker mounts over the image's own aren't listed. The build script's cp of /overlay/* leaves the dot
+// directory alone.
+const ReproducibleTemplate = `#!/bin/bash -e
+# reproducible build of {{.App}}
+state=/overlay/.reproducible
+touch "$state/started"
+# in case mtimes only have second resolution
+sleep 1
+
+"$@"
+
+prune=( \( -path /proc -o -path /sys -o -path /dev -o -path /overlay -o -path /.atlantis-gate
+  -o -path /etc/hostname -o -path /etc/hosts -o -path /etc/resolv.conf \) -prune )
+find / -xdev "${prune[@]}" -o -newer "$state/started" -print0 | xargs -0 -r touch -h -d "@$SOURCE_DATE_EPOCH"
+find / -xdev "${prune[@]}" -o -print0 | LC_ALL=C sort -z > "$state/files"
+
+while IFS= read -r -d '' file; do
+  if [ -L "$file" ]; then
+    content=$(readlink "$file")
+  elif [ -f "$file" ]; then
+    content=$(sha256sum < "$file" | cut -d' ' -f1)
+  else
+    content=-
+  fi
+  printf '%s\t%s\t%s\n' "$file" "$(stat -c '%F %a %u:%g' "$file")" "$content"
+done < "$state/files" > "$state/content.txt"
+sha256sum < "$state/content.txt" | cut -d' ' -f1 > "$state/digest"
+echo "content digest: $(cat "$state/digest")"
+`
+
+type Reproducible struct {
+	App string
+}
+
+func WriteReproducibleScript(path string, app string) {
+	tmpl := template.Must(template.New("reproducible").Parse(ReproducibleTemplate))
+	if fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0555); err != nil {
+		panic(err)
+	} else {
+		if err := tmpl.Execute(fh, Reproducible{app}); err != nil {
+			panic(err)
+		}
+	}
+}
+
 const SetupTemplate = `#!/bin/bash -x
 {{range .SetupCommands}}
 {{.}}
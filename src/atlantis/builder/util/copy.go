@@ -0,0 +1,161 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// CopyTree copies the tree at src into dst, which is created if it doesn't exist. Symlinks are copied as
+// they are rather than followed, directories and files keep their permission bits, files hardlinked to
+// each other within src are hardlinked to each other within dst, and sockets, fifos and devices are
+// skipped. skip, if not nil, is asked about every path below src, slash separated and relative to src;
+// skipping a directory skips everything in it.
+func CopyTree(src, dst string, skip func(relPath string, info os.FileInfo) bool) error {
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	dirs := []dirMode{}
+	links := map[inode]string{}
+
+	walk := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if relPath != "." && skip != nil && skip(filepath.ToSlash(relPath), info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, relPath)
+
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			// the real mode is set once everything in it is copied, in case it isn't writable
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{target, mode & modeBits})
+			return nil
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := removeExisting(target); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			if err := removeExisting(target); err != nil {
+				return err
+			}
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+				key := inode{uint64(stat.Dev), uint64(stat.Ino)}
+				if first, ok := links[key]; ok {
+					return os.Link(first, target)
+				}
+				links[key] = target
+			}
+			return copyFile(path, target, mode&modeBits)
+		default:
+			fmt.Printf("Not copying special file %s (%v)\n", path, mode)
+			return nil
+		}
+	}
+	if err := filepath.Walk(src, walk); err != nil {
+		return err
+	}
+
+	// innermost first, so making a directory read-only doesn't stop its subdirectories from being changed
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeExisting makes way for a new file at path, so a file or symlink already there is replaced rather
+// than written through.
+func removeExisting(path string) error {
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// ReadRegularFile reads the file at path, which must be a regular file, not a symlink to one, and no more
+// than max bytes. It's for files something less trusted than the builder wrote, a container say.
+func ReadRegularFile(path string, max int64) ([]byte, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(file, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("%s is over %d bytes", path, max)
+	}
+	return data, nil
+}
+
+func copyFile(from, to string, mode os.FileMode) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	// chmod rather than relying on OpenFile, whose mode the umask gets a say in
+	return os.Chmod(to, mode)
+}
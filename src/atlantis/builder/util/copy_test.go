@@ -0,0 +1,338 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+type copyTreeCase struct {
+	name string
+	// src is filled in before the copy, as is dst when the destination should already exist
+	src   func(src string) error
+	dst   func(dst string) error
+	skip  func(relPath string, info os.FileInfo) bool
+	check func(t reporter, dst string)
+}
+
+var copyTreeCases = []copyTreeCase{
+	{
+		name: "regular files",
+		src: func(src string) error {
+			if err := os.MkdirAll(filepath.Join(src, "a/b"), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(src, "top"), []byte("top"), 0644); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(src, "a/b/deep"), []byte("deep"), 0644)
+		},
+		check: func(t reporter, dst string) {
+			expectContent(t, filepath.Join(dst, "top"), "top")
+			expectContent(t, filepath.Join(dst, "a/b/deep"), "deep")
+		},
+	},
+	{
+		name: "hardlinks",
+		src: func(src string) error {
+			if err := ioutil.WriteFile(filepath.Join(src, "first"), []byte("shared"), 0644); err != nil {
+				return err
+			}
+			if err := os.Mkdir(filepath.Join(src, "dir"), 0755); err != nil {
+				return err
+			}
+			return os.Link(filepath.Join(src, "first"), filepath.Join(src, "dir/second"))
+		},
+		check: func(t reporter, dst string) {
+			first, err1 := os.Stat(filepath.Join(dst, "first"))
+			second, err2 := os.Stat(filepath.Join(dst, "dir/second"))
+			if err1 != nil || err2 != nil {
+				t.Fatalf("missing hardlinked files: %v %v", err1, err2)
+			}
+			if !os.SameFile(first, second) {
+				t.Errorf("first and dir/second aren't hardlinked")
+			}
+			expectContent(t, filepath.Join(dst, "dir/second"), "shared")
+		},
+	},
+	{
+		name: "symlinks",
+		src: func(src string) error {
+			if err := ioutil.WriteFile(filepath.Join(src, "target"), []byte("target"), 0644); err != nil {
+				return err
+			}
+			if err := os.Symlink("target", filepath.Join(src, "relative")); err != nil {
+				return err
+			}
+			if err := os.Symlink("/nonexistent/path", filepath.Join(src, "dangling")); err != nil {
+				return err
+			}
+			return os.Symlink(".", filepath.Join(src, "loop"))
+		},
+		check: func(t reporter, dst string) {
+			expectLink(t, filepath.Join(dst, "relative"), "target")
+			expectLink(t, filepath.Join(dst, "dangling"), "/nonexistent/path")
+			expectLink(t, filepath.Join(dst, "loop"), ".")
+		},
+	},
+	{
+		name: "mode bits",
+		src: func(src string) error {
+			if err := ioutil.WriteFile(filepath.Join(src, "script"), []byte("#!/bin/sh"), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(src, "secret"), []byte("secret"), 0600); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(src, "setuid"), []byte("setuid"), 0644); err != nil {
+				return err
+			}
+			if err := os.Chmod(filepath.Join(src, "setuid"), 0755|os.ModeSetuid); err != nil {
+				return err
+			}
+			if err := os.Mkdir(filepath.Join(src, "sticky"), 0755); err != nil {
+				return err
+			}
+			return os.Chmod(filepath.Join(src, "sticky"), 0777|os.ModeSticky)
+		},
+		check: func(t reporter, dst string) {
+			expectMode(t, filepath.Join(dst, "script"), 0755)
+			expectMode(t, filepath.Join(dst, "secret"), 0600)
+			expectMode(t, filepath.Join(dst, "setuid"), 0755|os.ModeSetuid)
+			expectMode(t, filepath.Join(dst, "sticky"), os.ModeDir|0777|os.ModeSticky)
+		},
+	},
+	{
+		name: "read-only directories",
+		src: func(src string) error {
+			if err := os.MkdirAll(filepath.Join(src, "ro/inner"), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(src, "ro/inner/file"), []byte("file"), 0444); err != nil {
+				return err
+			}
+			if err := os.Chmod(filepath.Join(src, "ro/inner"), 0555); err != nil {
+				return err
+			}
+			return os.Chmod(filepath.Join(src, "ro"), 0555)
+		},
+		check: func(t reporter, dst string) {
+			expectContent(t, filepath.Join(dst, "ro/inner/file"), "file")
+			expectMode(t, filepath.Join(dst, "ro/inner/file"), 0444)
+			expectMode(t, filepath.Join(dst, "ro/inner"), os.ModeDir|0555)
+			expectMode(t, filepath.Join(dst, "ro"), os.ModeDir|0555)
+		},
+	},
+	{
+		name: "existing destination",
+		src: func(src string) error {
+			if err := ioutil.WriteFile(filepath.Join(src, "file"), []byte("new"), 0644); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(src, "link"), []byte("plain"), 0644)
+		},
+		dst: func(dst string) error {
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(dst, "file"), []byte("old and longer"), 0600); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(dst, "outside"), []byte("untouched"), 0644); err != nil {
+				return err
+			}
+			// a symlink in the way is replaced, not written through
+			return os.Symlink("outside", filepath.Join(dst, "link"))
+		},
+		check: func(t reporter, dst string) {
+			expectContent(t, filepath.Join(dst, "file"), "new")
+			expectMode(t, filepath.Join(dst, "file"), 0644)
+			expectMode(t, filepath.Join(dst, "link"), 0644)
+			expectContent(t, filepath.Join(dst, "link"), "plain")
+			expectContent(t, filepath.Join(dst, "outside"), "untouched")
+		},
+	},
+	{
+		name: "ignore callback",
+		src: func(src string) error {
+			if err := os.MkdirAll(filepath.Join(src, "skipped/inner"), 0755); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Join(src, "kept"), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(src, "skipped/inner/file"), []byte("no"), 0644); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(src, "kept/file.log"), []byte("no"), 0644); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(src, "kept/file"), []byte("yes"), 0644)
+		},
+		skip: func(relPath string, info os.FileInfo) bool {
+			return relPath == "skipped" || strings.HasSuffix(relPath, ".log")
+		},
+		check: func(t reporter, dst string) {
+			expectMissing(t, filepath.Join(dst, "skipped"))
+			expectMissing(t, filepath.Join(dst, "kept/file.log"))
+			expectContent(t, filepath.Join(dst, "kept/file"), "yes")
+		},
+	},
+	{
+		name: "special files",
+		src: func(src string) error {
+			if err := syscall.Mkfifo(filepath.Join(src, "fifo"), 0644); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(src, "file"), []byte("file"), 0644)
+		},
+		check: func(t reporter, dst string) {
+			expectMissing(t, filepath.Join(dst, "fifo"))
+			expectContent(t, filepath.Join(dst, "file"), "file")
+		},
+	},
+}
+
+func TestCopyTree(t *testing.T) {
+	for _, c := range copyTreeCases {
+		runCopyTreeCase(t, c)
+	}
+}
+
+func runCopyTreeCase(t *testing.T, c copyTreeCase) {
+	tmp, err := ioutil.TempDir("", "copytree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeTree(tmp)
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.src(src); err != nil {
+		t.Fatalf("%s: setting up src: %v", c.name, err)
+	}
+	if c.dst != nil {
+		if err := c.dst(dst); err != nil {
+			t.Fatalf("%s: setting up dst: %v", c.name, err)
+		}
+	}
+	if err := CopyTree(src, dst, c.skip); err != nil {
+		t.Fatalf("%s: CopyTree: %v", c.name, err)
+	}
+	c.check(&namedT{t, c.name}, dst)
+}
+
+type reporter interface {
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// namedT prefixes failures with the name of the case, so the shared expectations don't need it.
+type namedT struct {
+	*testing.T
+	name string
+}
+
+func (t *namedT) Errorf(format string, args ...interface{}) {
+	t.T.Errorf(t.name+": "+format, args...)
+}
+
+func (t *namedT) Fatalf(format string, args ...interface{}) {
+	t.T.Fatalf(t.name+": "+format, args...)
+}
+
+// removeTree removes dir even when the test left read-only directories in it.
+func removeTree(dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+	os.RemoveAll(dir)
+}
+
+func expectContent(t reporter, path, content string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("reading %s: %v", path, err)
+	} else if string(data) != content {
+		t.Errorf("%s has %q, expected %q", path, data, content)
+	}
+}
+
+func expectMode(t reporter, path string, mode os.FileMode) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Errorf("stat of %s: %v", path, err)
+	} else if got := info.Mode() & (os.ModeType | modeBits); got != mode {
+		t.Errorf("%s has mode %v, expected %v", path, got, mode)
+	}
+}
+
+func expectLink(t reporter, path, target string) {
+	link, err := os.Readlink(path)
+	if err != nil {
+		t.Errorf("readlink of %s: %v", path, err)
+	} else if link != target {
+		t.Errorf("%s points at %s, expected %s", path, link, target)
+	}
+}
+
+func expectMissing(t reporter, path string) {
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("%s was copied", path)
+	}
+}
+
+func TestReadRegularFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "readregular")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, link, fifo := filepath.Join(dir, "file"), filepath.Join(dir, "link"), filepath.Join(dir, "fifo")
+	if err := ioutil.WriteFile(file, []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(file, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := ReadRegularFile(file, 5); err != nil || string(data) != "12345" {
+		t.Errorf("read %q, %v from a file of the limit, expected %q", data, err, "12345")
+	}
+	for _, c := range []struct {
+		name string
+		path string
+		max  int64
+	}{
+		{"over the limit", file, 4},
+		{"symlink", link, 5},
+		{"fifo", fifo, 5},
+		{"missing", filepath.Join(dir, "missing"), 5},
+	} {
+		if _, err := ReadRegularFile(c.path, c.max); err == nil {
+			t.Errorf("%s: read without an error", c.name)
+		}
+	}
+}